@@ -0,0 +1,155 @@
+package rtmp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+var errAggregateTruncated = errors.New("aggregate message truncated")
+
+// splitAggregate 把聚合消息拆分为子消息，子消息的时间戳以聚合消息的时间戳为基准重新计算
+func (conn *NetConnection) splitAggregate(msg *Chunk) (list []*Chunk, err error) {
+	body := util.Buffer(msg.AVData.ToBytes())
+	msg.AVData.Recycle()
+	var first uint32
+	for i := 0; body.Len() >= 11; i++ {
+		typeID := body.ReadByte()
+		size := int(body.ReadUint24())
+		ts := body.ReadUint24() | uint32(body.ReadByte())<<24
+		body.ReadUint24() // StreamID，总是0
+		if body.Len() < size+4 {
+			return list, errAggregateTruncated
+		}
+		if i == 0 {
+			first = ts
+		}
+		sub := &Chunk{ChunkHeader: msg.ChunkHeader}
+		sub.MessageTypeID = typeID
+		sub.MessageLength = uint32(size)
+		sub.ExtendTimestamp = msg.ExtendTimestamp + ts - first
+		data := body.ReadN(size)
+		body.ReadUint32() // PreviousTagSize
+		switch typeID {
+		case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
+			if size == 0 {
+				continue
+			}
+			mem := conn.bytePool.Get(size)
+			copy(mem.Value, data)
+			sub.AVData.Push(mem)
+		default:
+			if err = conn.decodeMessage(sub, data); err != nil {
+				return
+			}
+		}
+		list = append(list, sub)
+	}
+	// 剩余的字节不足一个子消息头
+	if body.Len() > 0 {
+		return list, errAggregateTruncated
+	}
+	return
+}
+
+// aggregator 把多个小帧合并为一个聚合消息发送，减少消息头的开销。
+// 没有后续的帧时由定时器在maxDuration之后发送，订阅结束时发送剩余的帧
+type aggregator struct {
+	AVSender
+	lock        sync.Mutex // 发送帧的协程和定时器都会访问buf
+	buf         util.Buffer
+	size        int    // 聚合消息的最大字节数，0表示不合并
+	maxDuration uint32 // 子消息的最大时间跨度，毫秒
+	firstTS     uint32 // 第一个子消息在客户端时间轴上的时间戳
+	timer       *time.Timer
+	closed      bool
+}
+
+// send 开启合并时经过聚合消息发送
+func (rtmp *RTMPSender) send(av *AVSender, frame *common.AVFrame, ts uint32) error {
+	if rtmp.aggregate.size > 0 {
+		return rtmp.aggregate.sendFrame(av, frame, ts)
+	}
+	return av.sendFrame(frame, ts)
+}
+
+// sendFrame 帧超过聚合消息的大小时直接发送，否则放入聚合消息
+func (agg *aggregator) sendFrame(av *AVSender, frame *common.AVFrame, ts uint32) error {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+	data := av.exTag(frame.AVCC.ToBytes())
+	tagSize := 11 + len(data)
+	if tagSize+4 > agg.size {
+		if err := agg.write(); err != nil {
+			return err
+		}
+		return av.sendFrame(frame, ts)
+	}
+	if agg.buf.Len()+tagSize+4 > agg.size || (agg.buf.Len() > 0 && ts-agg.firstTS >= agg.maxDuration) {
+		if err := agg.write(); err != nil {
+			return err
+		}
+	}
+	if agg.buf.Len() == 0 {
+		agg.firstTS = ts
+		agg.startTimer()
+	}
+	agg.buf.WriteByte(av.MessageTypeID)
+	agg.buf.WriteUint24(uint32(len(data)))
+	agg.buf.WriteUint24(ts & 0xFFFFFF)
+	agg.buf.WriteByte(byte(ts >> 24))
+	agg.buf.WriteUint24(0)
+	agg.buf.Write(data)
+	agg.buf.WriteUint32(uint32(tagSize))
+	return nil
+}
+
+// startTimer 第一个子消息放入后开始计时，需要持有lock
+func (agg *aggregator) startTimer() {
+	if agg.closed {
+		return
+	}
+	d := time.Duration(agg.maxDuration) * time.Millisecond
+	if agg.timer == nil {
+		agg.timer = time.AfterFunc(d, func() {
+			agg.flush()
+		})
+	} else {
+		agg.timer.Reset(d)
+	}
+}
+
+// close 订阅结束时发送剩余的帧并停止定时器
+func (agg *aggregator) close() {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+	agg.write()
+	agg.closed = true
+	if agg.timer != nil {
+		agg.timer.Stop()
+	}
+}
+
+// flush 发送已合并的帧，之后单独发送的帧需要使用绝对时间戳
+func (agg *aggregator) flush() error {
+	agg.lock.Lock()
+	defer agg.lock.Unlock()
+	return agg.write()
+}
+
+// write 需要持有lock
+func (agg *aggregator) write() error {
+	if agg.buf.Len() == 0 {
+		return nil
+	}
+	if agg.timer != nil {
+		agg.timer.Stop()
+	}
+	defer agg.buf.Reset()
+	agg.audio.firstSent.Store(false)
+	agg.video.firstSent.Store(false)
+	return agg.sendRaw(agg.buf, agg.firstTS)
+}
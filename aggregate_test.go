@@ -0,0 +1,249 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	engine "m7s.live/engine/v4"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+type aggTag struct {
+	typeID byte
+	ts     uint32
+	data   []byte
+}
+
+// aggregateBody 按FLV标签的格式拼接聚合消息的子消息，每个子消息之后是PreviousTagSize
+func aggregateBody(tags ...aggTag) []byte {
+	var b util.Buffer
+	for _, tag := range tags {
+		b.WriteByte(tag.typeID)
+		b.WriteUint24(uint32(len(tag.data)))
+		b.WriteUint24(tag.ts & 0xFFFFFF)
+		b.WriteByte(byte(tag.ts >> 24))
+		b.WriteUint24(0)
+		b.Write(tag.data)
+		b.WriteUint32(uint32(11 + len(tag.data)))
+	}
+	return b
+}
+
+func aggregateChunk(ts uint32, body []byte) *Chunk {
+	msg := &Chunk{ChunkHeader: ChunkHeader{ChunkStreamID: RTMP_CSID_AGGREGATE, MessageTypeID: RTMP_MSG_AGGREGATE, MessageStreamID: 1, ExtendTimestamp: ts}}
+	msg.MessageLength = uint32(len(body))
+	msg.AVData.Push(&util.ListItem[util.Buffer]{Value: body})
+	return msg
+}
+
+// 子消息的时间戳以第一个子消息为基准，加上聚合消息的时间戳，子消息时间戳的高8位也参与计算
+func TestSplitAggregate(t *testing.T) {
+	tags := []aggTag{
+		{RTMP_MSG_VIDEO, 0xFFFFF0, []byte{0x17, 1, 0, 0, 0, 0xAA}},
+		{RTMP_MSG_AUDIO, 0x1000000, []byte{0xAF, 1, 0xBB}},
+		{RTMP_MSG_AUDIO, 0x1000005, nil},
+		{RTMP_MSG_VIDEO, 0x1000010, []byte{0x27, 1, 0, 0, 0, 0xCC}},
+	}
+	conn := NewNetConnection(&bufferConn{reader: bytes.NewReader(nil)})
+	list, err := conn.splitAggregate(aggregateChunk(5000, aggregateBody(tags...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 空的音频子消息被丢弃
+	want := []aggTag{
+		{RTMP_MSG_VIDEO, 5000, tags[0].data},
+		{RTMP_MSG_AUDIO, 5016, tags[1].data},
+		{RTMP_MSG_VIDEO, 5032, tags[3].data},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("%d sub messages", len(list))
+	}
+	for i, sub := range list {
+		if sub.MessageTypeID != want[i].typeID || sub.ExtendTimestamp != want[i].ts || sub.MessageStreamID != 1 ||
+			sub.MessageLength != uint32(len(want[i].data)) || !bytes.Equal(sub.AVData.ToBytes(), want[i].data) {
+			t.Errorf("sub message %d: type %d, ts %d, data %x", i, sub.MessageTypeID, sub.ExtendTimestamp, sub.AVData.ToBytes())
+		}
+	}
+}
+
+// 截断在子消息中间、缺少PreviousTagSize或者剩余不足一个子消息头时返回错误
+func TestSplitAggregateTruncated(t *testing.T) {
+	body := aggregateBody(
+		aggTag{RTMP_MSG_VIDEO, 100, []byte{0x17, 1, 0, 0, 0, 0xAA}},
+		aggTag{RTMP_MSG_AUDIO, 120, []byte{0xAF, 1, 0xBB}},
+	)
+	first := 11 + 6 + 4
+	conn := NewNetConnection(&bufferConn{reader: bytes.NewReader(nil)})
+	for n := 1; n < len(body); n++ {
+		list, err := conn.splitAggregate(aggregateChunk(0, append([]byte(nil), body[:n]...)))
+		if n == first {
+			if err != nil || len(list) != 1 {
+				t.Errorf("%d bytes: %d sub messages, %v", n, len(list), err)
+			}
+		} else if err != errAggregateTruncated {
+			t.Errorf("%d bytes: %v", n, err)
+		}
+	}
+	// 子消息的长度超过聚合消息
+	body = aggregateBody(aggTag{RTMP_MSG_VIDEO, 0, []byte{0x17, 1, 0, 0, 0}})
+	body[1], body[2], body[3] = 0xFF, 0xFF, 0xFF
+	if _, err := conn.splitAggregate(aggregateChunk(0, body)); err != errAggregateTruncated {
+		t.Errorf("oversized sub message: %v", err)
+	}
+}
+
+// lockedConn 发送帧的协程之外的协程也会写入，读取时需要加锁
+type lockedConn struct {
+	sync.Mutex
+	bufferConn
+}
+
+func (c *lockedConn) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.written.Write(p)
+}
+
+// Bytes 返回已写入的数据的副本
+func (c *lockedConn) Bytes() []byte {
+	c.Lock()
+	defer c.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+// newTestSender 创建订阅了streamPath的播放端，发送的消息写入lockedConn
+func newTestSender(t *testing.T, streamPath string) (*RTMPSender, *lockedConn) {
+	c := &lockedConn{bufferConn: bufferConn{reader: bytes.NewReader(nil)}}
+	rtmp := &RTMPSender{}
+	rtmp.NetStream = NetStream{NewNetConnection(c), 1, newStreamInfo(nil, path.Dir(streamPath), path.Base(streamPath))}
+	rtmp.Stream = &engine.Stream{Path: streamPath}
+	rtmp.OnEvent(rtmp)
+	t.Cleanup(func() {
+		rtmp.aggregate.close()
+		rtmp.leaveDataRelay()
+	})
+	return rtmp, c
+}
+
+// newAggregateSender 创建开启合并的播放端
+func newAggregateSender(t *testing.T, size int, maxDuration uint32) (*RTMPSender, *lockedConn) {
+	rtmp, c := newTestSender(t, "live/aggregate")
+	rtmp.aggregate.size = size
+	rtmp.aggregate.maxDuration = maxDuration
+	return rtmp, c
+}
+
+func avFrame(ts uint32, data ...byte) *common.AVFrame {
+	frame := &common.AVFrame{Timestamp: time.Duration(ts) * time.Millisecond}
+	frame.AVCC.Push(&util.ListItem[util.Buffer]{Value: data})
+	return frame
+}
+
+// receivedTags 以接收端的方式读取发送的消息，聚合消息被拆分为子消息
+func receivedTags(t *testing.T, written []byte) (tags []aggTag, aggregates int) {
+	t.Helper()
+	conn := NewNetConnection(&bufferConn{reader: bytes.NewReader(written)})
+	for {
+		if len(conn.aggregated) == 0 {
+			// 下一个消息是聚合消息时RecvMessage会拆分它
+			if b, err := conn.Peek(8); err == nil && b[7] == RTMP_MSG_AGGREGATE {
+				aggregates++
+			}
+		}
+		msg, err := conn.RecvMessage()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, aggTag{msg.MessageTypeID, msg.ExtendTimestamp, msg.AVData.ToBytes()})
+	}
+}
+
+func checkTags(t *testing.T, got, want []aggTag) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d tags, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].typeID != want[i].typeID || got[i].ts != want[i].ts || !bytes.Equal(got[i].data, want[i].data) {
+			t.Errorf("tag %d: type %d, ts %d, data %x", i, got[i].typeID, got[i].ts, got[i].data)
+		}
+	}
+}
+
+// 没有后续的帧时定时器在maxDuration之后发送聚合消息，音视频按发送的顺序排列
+func TestAggregateFlushTimer(t *testing.T) {
+	rtmp, c := newAggregateSender(t, 4096, 50)
+	frames := []aggTag{
+		{RTMP_MSG_VIDEO, 1000, []byte{0x17, 1, 0, 0, 0, 0xAA}},
+		{RTMP_MSG_AUDIO, 1005, []byte{0xAF, 1, 0xBB}},
+		{RTMP_MSG_AUDIO, 1010, []byte{0xAF, 1, 0xCC}},
+		{RTMP_MSG_VIDEO, 1015, []byte{0x27, 1, 0, 0, 0, 0xDD}},
+	}
+	for _, f := range frames {
+		av := &rtmp.audio
+		if f.typeID == RTMP_MSG_VIDEO {
+			av = &rtmp.video
+		}
+		if err := rtmp.send(av, avFrame(f.ts, f.data...), f.ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.Bytes()) != 0 {
+		t.Fatal("aggregate message sent before the timer")
+	}
+	waitFor(t, func() bool {
+		rtmp.aggregate.lock.Lock()
+		defer rtmp.aggregate.lock.Unlock()
+		return rtmp.aggregate.buf.Len() == 0
+	})
+	tags, aggregates := receivedTags(t, c.Bytes())
+	if aggregates != 1 {
+		t.Errorf("%d aggregate messages", aggregates)
+	}
+	checkTags(t, tags, frames)
+}
+
+// 超过聚合消息大小的帧单独发送，之前先发送已合并的帧；时间跨度达到maxDuration时开始新的聚合消息；结束时发送剩余的帧
+func TestAggregateSend(t *testing.T) {
+	rtmp, c := newAggregateSender(t, 64, 1000)
+	big := append([]byte{0x17, 1, 0, 0, 0}, make([]byte, 100)...)
+	frames := []aggTag{
+		{RTMP_MSG_AUDIO, 0, []byte{0xAF, 1, 1}},
+		{RTMP_MSG_VIDEO, 0, big},
+		{RTMP_MSG_AUDIO, 20, []byte{0xAF, 1, 2}},
+		{RTMP_MSG_AUDIO, 1020, []byte{0xAF, 1, 3}},
+		{RTMP_MSG_AUDIO, 1040, []byte{0xAF, 1, 4}},
+	}
+	for _, f := range frames {
+		av := &rtmp.audio
+		if f.typeID == RTMP_MSG_VIDEO {
+			av = &rtmp.video
+		}
+		if err := rtmp.send(av, avFrame(f.ts, f.data...), f.ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rtmp.aggregate.close()
+	tags, aggregates := receivedTags(t, c.Bytes())
+	// [0] big [20] [1020 1040]
+	if aggregates != 3 {
+		t.Errorf("%d aggregate messages", aggregates)
+	}
+	checkTags(t, tags, frames)
+	// 关闭之后定时器不再启动
+	if err := rtmp.send(&rtmp.audio, avFrame(1060, 0xAF, 1, 5), 1060); err != nil {
+		t.Fatal(err)
+	}
+	if rtmp.aggregate.timer.Stop() {
+		t.Error("timer started after close")
+	}
+}
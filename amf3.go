@@ -0,0 +1,883 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+// amfReader 命令消息和数据消息的解析接口，AMF0编码使用util.AMF，AMF3编码使用amfDecoder
+type amfReader interface {
+	Len() int
+	ReadShortString() string
+	ReadNumber() float64
+	ReadBool() bool
+	ReadObject() map[string]any
+	Unmarshal() (any, error)
+}
+
+var errAMFTruncated = errors.New("amf data truncated")
+
+// 解析客户端发送的数据时的限制，防止恶意的数据耗尽栈和内存
+const (
+	maxAMFDepth      = 64      // 对象、数组的最大嵌套层数
+	maxAMFReferences = 1 << 16 // 引用表的最大长度，包括AMF0对象、AMF3字符串、对象和类型描述
+	maxAMFElements   = 1 << 20 // 数组、Vector、Dictionary的最大元素个数
+	maxAMFValues     = 1 << 20 // 一个消息中值的最大个数，被引用的对象按其中包含的值重复计算，防止引用使编码和保存的数据成倍增长
+)
+
+var (
+	errAMFTooDeep         = errors.New("amf nested too deep")
+	errAMFTooManyRefs     = errors.New("amf reference table too large")
+	errAMFCyclicRef       = errors.New("amf reference to an object being decoded")
+	errAMFTooManyElements = errors.New("amf array too large")
+	errAMFTooManyValues   = errors.New("amf data expands to too many values")
+)
+
+// amf3Traits AMF3对象的类型描述，可以被后续对象引用
+type amf3Traits struct {
+	className      string
+	externalizable bool
+	dynamic        bool
+	sealed         []string
+}
+
+// amfDecoder 解析类型15、16、17的消息体，外层为AMF0编码，遇到avmplus标记(0x11)时下一个值切换为AMF3编码。
+// 解析结果与util.AMF保持一致：数字为float64，对象和ECMA数组为map[string]any，严格数组为[]any。
+// 日期为time.Time，XML为string，ByteArray为[]byte。
+// 引用正在解析的对象（形成环）时返回错误，之后编码、转换为字符串和保存时不需要处理环。
+type amfDecoder struct {
+	data    []byte
+	depth   int
+	values  int   // 已解析的值的个数
+	objects []any // AMF0对象引用表
+	weights []int // 引用表中每个对象包含的值的个数，正在解析时为开始时的values
+	open    []int // 正在解析的AMF0对象在引用表中的序号
+	// AMF3引用表，每次切换到AMF3时重置
+	strings3 []string
+	objects3 []any
+	weights3 []int
+	traits3  []*amf3Traits
+	open3    []int
+}
+
+func newAMFDecoder(body []byte) *amfDecoder {
+	return &amfDecoder{data: body}
+}
+
+func (d *amfDecoder) Len() int {
+	return len(d.data)
+}
+
+func (d *amfDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data) < n {
+		return nil, errAMFTruncated
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *amfDecoder) readByte() (byte, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *amfDecoder) readUint16() (uint16, error) {
+	b, err := d.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (d *amfDecoder) readUint32() (uint32, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (d *amfDecoder) readDouble() (float64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
+
+// checkCount 每个元素至少占一个字节，防止恶意的长度导致分配过大的内存
+func (d *amfDecoder) checkCount(n int) error {
+	if n < 0 || n > len(d.data) {
+		return errAMFTruncated
+	}
+	if n > maxAMFElements {
+		return errAMFTooManyElements
+	}
+	return nil
+}
+
+// enter 开始解析一个值，返回nil时需要调用leave
+func (d *amfDecoder) enter() error {
+	if d.depth >= maxAMFDepth {
+		return errAMFTooDeep
+	}
+	if err := d.count(1); err != nil {
+		return err
+	}
+	d.depth++
+	return nil
+}
+
+// count 累计解析结果中值的个数，引用的对象计入其中全部的值
+func (d *amfDecoder) count(n int) error {
+	if d.values += n; d.values > maxAMFValues {
+		return errAMFTooManyValues
+	}
+	return nil
+}
+
+func (d *amfDecoder) leave() {
+	d.depth--
+}
+
+func (d *amfDecoder) checkRefs() error {
+	if len(d.objects)+len(d.strings3)+len(d.objects3)+len(d.traits3) >= maxAMFReferences {
+		return errAMFTooManyRefs
+	}
+	return nil
+}
+
+// push 把正在解析的AMF0对象加入引用表，返回nil时需要调用pop
+func (d *amfDecoder) push(v any) error {
+	if err := d.checkRefs(); err != nil {
+		return err
+	}
+	d.open = append(d.open, len(d.objects))
+	d.objects = append(d.objects, v)
+	d.weights = append(d.weights, d.values)
+	return nil
+}
+
+func (d *amfDecoder) pop() {
+	i := d.open[len(d.open)-1]
+	d.weights[i] = d.values - d.weights[i]
+	d.open = d.open[:len(d.open)-1]
+}
+
+// add3 把解析完成的AMF3对象加入引用表
+func (d *amfDecoder) add3(v any) error {
+	if err := d.checkRefs(); err != nil {
+		return err
+	}
+	d.objects3 = append(d.objects3, v)
+	d.weights3 = append(d.weights3, 1)
+	return nil
+}
+
+// push3 把正在解析的AMF3对象加入引用表，返回序号，之后可以替换为最终的值。返回nil时需要调用pop3
+func (d *amfDecoder) push3(v any) (int, error) {
+	if err := d.checkRefs(); err != nil {
+		return 0, err
+	}
+	d.open3 = append(d.open3, len(d.objects3))
+	d.objects3 = append(d.objects3, v)
+	d.weights3 = append(d.weights3, d.values)
+	return len(d.objects3) - 1, nil
+}
+
+func (d *amfDecoder) pop3() {
+	i := d.open3[len(d.open3)-1]
+	d.weights3[i] = d.values - d.weights3[i]
+	d.open3 = d.open3[:len(d.open3)-1]
+}
+
+func isOpen(open []int, i int) bool {
+	for _, o := range open {
+		if o == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *amfDecoder) ReadShortString() string {
+	v, _ := d.Unmarshal()
+	s, _ := v.(string)
+	return s
+}
+
+func (d *amfDecoder) ReadNumber() float64 {
+	v, _ := d.Unmarshal()
+	n, _ := v.(float64)
+	return n
+}
+
+func (d *amfDecoder) ReadBool() bool {
+	v, _ := d.Unmarshal()
+	b, _ := v.(bool)
+	return b
+}
+
+func (d *amfDecoder) ReadObject() map[string]any {
+	v, _ := d.Unmarshal()
+	obj, _ := v.(map[string]any)
+	return obj
+}
+
+// Unmarshal 读取一个AMF0值
+func (d *amfDecoder) Unmarshal() (any, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	t, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case util.AMF0_NUMBER:
+		return d.readDouble()
+	case util.AMF0_BOOLEAN:
+		b, err := d.readByte()
+		return b != 0, err
+	case util.AMF0_STRING:
+		return d.readString0()
+	case util.AMF0_LONG_STRING, util.AMF0_XML_DOCUMENT:
+		return d.readLongString0()
+	case util.AMF0_NULL, util.AMF0_UNDEFINED, util.AMF0_UNSUPPORTED:
+		return nil, nil
+	case util.AMF0_OBJECT:
+		return d.readProperties0(make(map[string]any))
+	case util.AMF0_TYPED_OBJECT:
+		if _, err = d.readString0(); err != nil {
+			return nil, err
+		}
+		return d.readProperties0(make(map[string]any))
+	case util.AMF0_ECMA_ARRAY:
+		if _, err = d.readUint32(); err != nil {
+			return nil, err
+		}
+		return d.readProperties0(make(map[string]any))
+	case util.AMF0_STRICT_ARRAY:
+		n, err := d.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		if err = d.checkCount(int(n)); err != nil {
+			return nil, err
+		}
+		arr := make([]any, n)
+		if err = d.push(arr); err != nil {
+			return nil, err
+		}
+		defer d.pop()
+		for i := range arr {
+			if arr[i], err = d.Unmarshal(); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case util.AMF0_DATE:
+		ms, err := d.readDouble()
+		if err != nil {
+			return nil, err
+		}
+		_, err = d.readUint16() // 时区，总是0
+		return time.UnixMilli(int64(ms)), err
+	case util.AMF0_REFERENCE:
+		i, err := d.readUint16()
+		if err != nil {
+			return nil, err
+		}
+		if int(i) >= len(d.objects) {
+			return nil, fmt.Errorf("amf0 reference %d out of range", i)
+		}
+		if isOpen(d.open, int(i)) {
+			return nil, errAMFCyclicRef
+		}
+		return d.objects[i], d.count(d.weights[i])
+	case util.AMF0_AVMPLUS_OBJECT:
+		d.strings3, d.objects3, d.weights3, d.traits3, d.open3 = nil, nil, nil, nil, nil
+		return d.unmarshal3()
+	}
+	return nil, fmt.Errorf("unsupported amf0 type %d", t)
+}
+
+func (d *amfDecoder) readString0() (string, error) {
+	n, err := d.readUint16()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.read(int(n))
+	return string(b), err
+}
+
+func (d *amfDecoder) readLongString0() (string, error) {
+	n, err := d.readUint32()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.read(int(n))
+	return string(b), err
+}
+
+// readProperties0 读取对象的属性直到空的键和结束标记
+func (d *amfDecoder) readProperties0(obj map[string]any) (map[string]any, error) {
+	if err := d.push(obj); err != nil {
+		return nil, err
+	}
+	defer d.pop()
+	for {
+		k, err := d.readString0()
+		if err != nil {
+			return nil, err
+		}
+		if k == "" {
+			if len(d.data) > 0 && d.data[0] == util.AMF0_END_OBJECT {
+				d.data = d.data[1:]
+				return obj, nil
+			}
+		}
+		if obj[k], err = d.Unmarshal(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readU29 读取AMF3的可变长度整数，最多4个字节
+func (d *amfDecoder) readU29() (uint32, error) {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if i == 3 {
+			return v<<8 | uint32(b), nil
+		}
+		v = v<<7 | uint32(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return v, nil
+}
+
+// readRef 读取U29，最低位为0时返回引用表中的序号
+func (d *amfDecoder) readRef() (v uint32, isRef bool, err error) {
+	if v, err = d.readU29(); err != nil {
+		return
+	}
+	return v >> 1, v&1 == 0, nil
+}
+
+func (d *amfDecoder) objectRef(i uint32) (any, error) {
+	if int(i) >= len(d.objects3) {
+		return nil, fmt.Errorf("amf3 object reference %d out of range", i)
+	}
+	if isOpen(d.open3, int(i)) {
+		return nil, errAMFCyclicRef
+	}
+	return d.objects3[i], d.count(d.weights3[i])
+}
+
+func (d *amfDecoder) readString3() (string, error) {
+	v, isRef, err := d.readRef()
+	if err != nil {
+		return "", err
+	}
+	if isRef {
+		if int(v) >= len(d.strings3) {
+			return "", fmt.Errorf("amf3 string reference %d out of range", v)
+		}
+		return d.strings3[v], nil
+	}
+	b, err := d.read(int(v))
+	if err != nil {
+		return "", err
+	}
+	// 空字符串不加入引用表
+	if s := string(b); s != "" {
+		if err = d.checkRefs(); err != nil {
+			return "", err
+		}
+		d.strings3 = append(d.strings3, s)
+		return s, nil
+	}
+	return "", nil
+}
+
+// unmarshal3 读取一个AMF3值
+func (d *amfDecoder) unmarshal3() (any, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	t, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case util.AMF3_UNDEFINED, util.AMF3_NULL:
+		return nil, nil
+	case util.AMF3_FALSE:
+		return false, nil
+	case util.AMF3_TRUE:
+		return true, nil
+	case util.AMF3_INTEGER:
+		v, err := d.readU29()
+		if err != nil {
+			return nil, err
+		}
+		// 29位有符号整数
+		return float64(int32(v<<3) >> 3), nil
+	case util.AMF3_DOUBLE:
+		return d.readDouble()
+	case util.AMF3_STRING:
+		return d.readString3()
+	case util.AMF3_XML_DOC, util.AMF3_XML:
+		v, isRef, err := d.readRef()
+		if err != nil || isRef {
+			return d.refOrErr(v, err)
+		}
+		b, err := d.read(int(v))
+		if err != nil {
+			return nil, err
+		}
+		return string(b), d.add3(string(b))
+	case util.AMF3_DATE:
+		v, isRef, err := d.readRef()
+		if err != nil || isRef {
+			return d.refOrErr(v, err)
+		}
+		ms, err := d.readDouble()
+		if err != nil {
+			return nil, err
+		}
+		date := time.UnixMilli(int64(ms))
+		return date, d.add3(date)
+	case util.AMF3_ARRAY:
+		return d.readArray3()
+	case util.AMF3_OBJECT:
+		return d.readObject3()
+	case util.AMF3_BYTE_ARRAY:
+		v, isRef, err := d.readRef()
+		if err != nil || isRef {
+			return d.refOrErr(v, err)
+		}
+		b, err := d.read(int(v))
+		if err != nil {
+			return nil, err
+		}
+		ba := append([]byte(nil), b...)
+		return ba, d.add3(ba)
+	case util.AMF3_VECTOR_INT, util.AMF3_VECTOR_UINT, util.AMF3_VECTOR_DOUBLE, util.AMF3_VECTOR_OBJECT:
+		return d.readVector3(t)
+	case util.AMF3_DICTIONARY:
+		return d.readDictionary3()
+	}
+	return nil, fmt.Errorf("unsupported amf3 type %d", t)
+}
+
+func (d *amfDecoder) refOrErr(i uint32, err error) (any, error) {
+	if err != nil {
+		return nil, err
+	}
+	return d.objectRef(i)
+}
+
+// readArray3 只有稠密部分时返回[]any，有关联部分时返回map[string]any，稠密部分以序号作为键
+func (d *amfDecoder) readArray3() (any, error) {
+	v, isRef, err := d.readRef()
+	if err != nil || isRef {
+		return d.refOrErr(v, err)
+	}
+	if err = d.checkCount(int(v)); err != nil {
+		return nil, err
+	}
+	index, err := d.push3(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer d.pop3()
+	var assoc map[string]any
+	for {
+		k, err := d.readString3()
+		if err != nil {
+			return nil, err
+		}
+		if k == "" {
+			break
+		}
+		if assoc == nil {
+			assoc = make(map[string]any)
+			d.objects3[index] = assoc
+		}
+		if assoc[k], err = d.unmarshal3(); err != nil {
+			return nil, err
+		}
+	}
+	dense := make([]any, v)
+	if assoc == nil {
+		d.objects3[index] = dense
+	}
+	for i := range dense {
+		if dense[i], err = d.unmarshal3(); err != nil {
+			return nil, err
+		}
+	}
+	if assoc == nil {
+		return dense, nil
+	}
+	for i, item := range dense {
+		assoc[strconv.Itoa(i)] = item
+	}
+	return assoc, nil
+}
+
+func (d *amfDecoder) readTraits3(v uint32) (*amf3Traits, error) {
+	// v已经去掉了对象引用标志位
+	if v&1 == 0 {
+		if int(v>>1) >= len(d.traits3) {
+			return nil, fmt.Errorf("amf3 traits reference %d out of range", v>>1)
+		}
+		return d.traits3[v>>1], nil
+	}
+	traits := &amf3Traits{externalizable: v&2 != 0, dynamic: v&4 != 0}
+	err := d.checkRefs()
+	if err != nil {
+		return nil, err
+	}
+	if traits.className, err = d.readString3(); err != nil {
+		return nil, err
+	}
+	if !traits.externalizable {
+		count := int(v >> 3)
+		if err = d.checkCount(count); err != nil {
+			return nil, err
+		}
+		traits.sealed = make([]string, count)
+		for i := range traits.sealed {
+			if traits.sealed[i], err = d.readString3(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.traits3 = append(d.traits3, traits)
+	return traits, nil
+}
+
+// readObject3 读取对象，先读取固定成员再读取动态成员
+func (d *amfDecoder) readObject3() (any, error) {
+	v, isRef, err := d.readRef()
+	if err != nil || isRef {
+		return d.refOrErr(v, err)
+	}
+	traits, err := d.readTraits3(v)
+	if err != nil {
+		return nil, err
+	}
+	if traits.externalizable {
+		switch traits.className {
+		case "flex.messaging.io.ArrayCollection", "flex.messaging.io.ObjectProxy":
+			// 序列化内容为一个普通的AMF3值
+			index, err := d.push3(nil)
+			if err != nil {
+				return nil, err
+			}
+			defer d.pop3()
+			value, err := d.unmarshal3()
+			d.objects3[index] = value
+			return value, err
+		}
+		return nil, fmt.Errorf("unsupported amf3 externalizable class %s", traits.className)
+	}
+	obj := make(map[string]any, len(traits.sealed))
+	if _, err = d.push3(obj); err != nil {
+		return nil, err
+	}
+	defer d.pop3()
+	for _, k := range traits.sealed {
+		if obj[k], err = d.unmarshal3(); err != nil {
+			return nil, err
+		}
+	}
+	for traits.dynamic {
+		k, err := d.readString3()
+		if err != nil {
+			return nil, err
+		}
+		if k == "" {
+			break
+		}
+		if obj[k], err = d.unmarshal3(); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// readVector3 Vector.<int>、Vector.<uint>、Vector.<Number>分别返回[]int32、[]uint32、[]float64，Vector.<Object>返回[]any
+func (d *amfDecoder) readVector3(t byte) (any, error) {
+	v, isRef, err := d.readRef()
+	if err != nil || isRef {
+		return d.refOrErr(v, err)
+	}
+	if err = d.checkCount(int(v)); err != nil {
+		return nil, err
+	}
+	if _, err = d.readByte(); err != nil { // fixed-vector标志
+		return nil, err
+	}
+	n := int(v)
+	switch t {
+	case util.AMF3_VECTOR_INT, util.AMF3_VECTOR_UINT:
+		b, err := d.read(n * 4)
+		if err != nil {
+			return nil, err
+		}
+		var vec any
+		if t == util.AMF3_VECTOR_INT {
+			ints := make([]int32, n)
+			for i := range ints {
+				ints[i] = int32(binary.BigEndian.Uint32(b[i*4:]))
+			}
+			vec = ints
+		} else {
+			uints := make([]uint32, n)
+			for i := range uints {
+				uints[i] = binary.BigEndian.Uint32(b[i*4:])
+			}
+			vec = uints
+		}
+		return vec, d.add3(vec)
+	case util.AMF3_VECTOR_DOUBLE:
+		b, err := d.read(n * 8)
+		if err != nil {
+			return nil, err
+		}
+		doubles := make([]float64, n)
+		for i := range doubles {
+			doubles[i] = math.Float64frombits(binary.BigEndian.Uint64(b[i*8:]))
+		}
+		return doubles, d.add3(doubles)
+	}
+	if _, err = d.readString3(); err != nil { // 元素的类型名
+		return nil, err
+	}
+	objects := make([]any, n)
+	if _, err = d.push3(objects); err != nil {
+		return nil, err
+	}
+	defer d.pop3()
+	for i := range objects {
+		if objects[i], err = d.unmarshal3(); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// readDictionary3 键可以是任意类型，字符串、数字、布尔转换为字符串作为map的键，
+// 对象等其他类型的键没有可读的字符串形式，使用[object 序号]
+func (d *amfDecoder) readDictionary3() (any, error) {
+	v, isRef, err := d.readRef()
+	if err != nil || isRef {
+		return d.refOrErr(v, err)
+	}
+	if err = d.checkCount(int(v)); err != nil {
+		return nil, err
+	}
+	if _, err = d.readByte(); err != nil { // weak-keys标志
+		return nil, err
+	}
+	dict := make(map[string]any, v)
+	if _, err = d.push3(dict); err != nil {
+		return nil, err
+	}
+	defer d.pop3()
+	for i := 0; i < int(v); i++ {
+		k, err := d.unmarshal3()
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("[object %d]", i)
+		switch k.(type) {
+		case nil, bool, float64, string:
+			key = fmt.Sprint(k)
+		}
+		if dict[key], err = d.unmarshal3(); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+// avmplusAMF 客户端协商objectEncoding为3时使用的编码，基础类型仍然用AMF0编码，
+// 对象、数组、日期和ByteArray写入avmplus标记后用AMF3编码
+type avmplusAMF struct {
+	util.AMF
+}
+
+func (amf *avmplusAMF) Marshals(args ...any) []byte {
+	for _, v := range args {
+		amf.Marshal(v)
+	}
+	return amf.Buffer
+}
+
+func (amf *avmplusAMF) Marshal(v any) []byte {
+	switch v.(type) {
+	case nil, bool, string, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return amf.AMF.Marshal(v)
+	}
+	amf.WriteByte(util.AMF0_AVMPLUS_OBJECT)
+	var enc amf3Encoder
+	enc.encode(v)
+	amf.Write(enc.Buffer)
+	return amf.Buffer
+}
+
+// amf3Encoder AMF3编码，只使用字符串引用表，对象总是内联编码
+type amf3Encoder struct {
+	util.Buffer
+	strings map[string]int
+}
+
+func (enc *amf3Encoder) writeU29(v uint32) {
+	v &= 0x1FFFFFFF
+	switch {
+	case v < 0x80:
+		enc.WriteByte(byte(v))
+	case v < 0x4000:
+		enc.Write([]byte{byte(v>>7 | 0x80), byte(v & 0x7F)})
+	case v < 0x200000:
+		enc.Write([]byte{byte(v>>14 | 0x80), byte(v>>7 | 0x80), byte(v & 0x7F)})
+	default:
+		enc.Write([]byte{byte(v>>22 | 0x80), byte(v>>15 | 0x80), byte(v>>8 | 0x80), byte(v)})
+	}
+}
+
+func (enc *amf3Encoder) writeString(s string) {
+	if s == "" {
+		enc.WriteByte(0x01)
+		return
+	}
+	if i, ok := enc.strings[s]; ok {
+		enc.writeU29(uint32(i) << 1)
+		return
+	}
+	if enc.strings == nil {
+		enc.strings = make(map[string]int)
+	}
+	enc.strings[s] = len(enc.strings)
+	enc.writeU29(uint32(len(s))<<1 | 1)
+	enc.Write([]byte(s))
+}
+
+func (enc *amf3Encoder) writeDouble(f float64) {
+	enc.WriteByte(util.AMF3_DOUBLE)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	enc.Write(b[:])
+}
+
+func (enc *amf3Encoder) writeInt(i int64) {
+	// 超出29位有符号整数范围的使用double
+	if i < -(1<<28) || i >= 1<<28 {
+		enc.writeDouble(float64(i))
+		return
+	}
+	enc.WriteByte(util.AMF3_INTEGER)
+	enc.writeU29(uint32(i))
+}
+
+func (enc *amf3Encoder) writeUint(u uint64) {
+	if u > math.MaxInt64 {
+		enc.writeDouble(float64(u))
+		return
+	}
+	enc.writeInt(int64(u))
+}
+
+func (enc *amf3Encoder) encode(v any) {
+	switch vv := v.(type) {
+	case nil:
+		enc.WriteByte(util.AMF3_NULL)
+	case bool:
+		if vv {
+			enc.WriteByte(util.AMF3_TRUE)
+		} else {
+			enc.WriteByte(util.AMF3_FALSE)
+		}
+	case int:
+		enc.writeInt(int64(vv))
+	case int8:
+		enc.writeInt(int64(vv))
+	case int16:
+		enc.writeInt(int64(vv))
+	case int32:
+		enc.writeInt(int64(vv))
+	case int64:
+		enc.writeInt(vv)
+	case uint:
+		enc.writeUint(uint64(vv))
+	case uint8:
+		enc.writeInt(int64(vv))
+	case uint16:
+		enc.writeInt(int64(vv))
+	case uint32:
+		enc.writeInt(int64(vv))
+	case uint64:
+		enc.writeUint(vv)
+	case float32:
+		enc.writeDouble(float64(vv))
+	case float64:
+		enc.writeDouble(vv)
+	case string:
+		enc.WriteByte(util.AMF3_STRING)
+		enc.writeString(vv)
+	case time.Time:
+		enc.WriteByte(util.AMF3_DATE)
+		enc.writeU29(1)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(float64(vv.UnixMilli())))
+		enc.Write(b[:])
+	case []byte:
+		enc.WriteByte(util.AMF3_BYTE_ARRAY)
+		enc.writeU29(uint32(len(vv))<<1 | 1)
+		enc.Write(vv)
+	case []any:
+		enc.WriteByte(util.AMF3_ARRAY)
+		enc.writeU29(uint32(len(vv))<<1 | 1)
+		enc.writeString("")
+		for _, item := range vv {
+			enc.encode(item)
+		}
+	case map[string]any:
+		// 匿名的动态对象，没有固定成员
+		enc.WriteByte(util.AMF3_OBJECT)
+		enc.writeU29(0x0B)
+		enc.writeString("")
+		for k, item := range vv {
+			if k == "" {
+				continue
+			}
+			enc.writeString(k)
+			enc.encode(item)
+		}
+		enc.writeString("")
+	default:
+		enc.WriteByte(util.AMF3_UNDEFINED)
+	}
+}
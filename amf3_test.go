@@ -0,0 +1,267 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+// unmarshal3 从0x11标记开始解析一个AMF3值
+func unmarshal3(t *testing.T, s string) any {
+	t.Helper()
+	d := newAMFDecoder(unhex(s))
+	v, err := d.Unmarshal()
+	if err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	if d.Len() != 0 {
+		t.Fatalf("%s: %d bytes left", s, d.Len())
+	}
+	return v
+}
+
+// U29的每个字节长度的边界，超出29位有符号整数范围的整数编码为double
+func TestU29(t *testing.T) {
+	tests := []struct {
+		v    uint32
+		size int
+	}{
+		{0, 1}, {0x7F, 1}, {0x80, 2}, {0x3FFF, 2}, {0x4000, 3},
+		{0x1FFFFF, 3}, {0x200000, 4}, {0x0FFFFFFF, 4}, {0x1FFFFFFF, 4},
+	}
+	for _, tt := range tests {
+		var enc amf3Encoder
+		enc.writeU29(tt.v)
+		if len(enc.Buffer) != tt.size {
+			t.Errorf("%#x: encoded %x", tt.v, []byte(enc.Buffer))
+		}
+		if v, err := newAMFDecoder(enc.Buffer).readU29(); err != nil || v != tt.v {
+			t.Errorf("%#x: decoded %#x, %v", tt.v, v, err)
+		}
+	}
+
+	ints := []struct {
+		v      int64
+		double bool
+	}{
+		{0, false}, {-1, false}, {1<<28 - 1, false}, {-(1 << 28), false},
+		{1 << 28, true}, {-(1 << 28) - 1, true}, {math.MaxInt64, true},
+	}
+	for _, tt := range ints {
+		var enc amf3Encoder
+		enc.writeInt(tt.v)
+		if isDouble := enc.Buffer[0] == util.AMF3_DOUBLE; isDouble != tt.double {
+			t.Errorf("%d: encoded %x", tt.v, []byte(enc.Buffer))
+		}
+		v, err := newAMFDecoder(enc.Buffer).unmarshal3()
+		if err != nil || v != float64(tt.v) {
+			t.Errorf("%d: decoded %v, %v", tt.v, v, err)
+		}
+	}
+	var enc amf3Encoder
+	enc.writeUint(math.MaxUint64)
+	if enc.Buffer[0] != util.AMF3_DOUBLE {
+		t.Errorf("MaxUint64 encoded %x", []byte(enc.Buffer))
+	}
+}
+
+func TestAMF3References(t *testing.T) {
+	// 第二个字符串引用第一个
+	if v := unmarshal3(t, "11 09 05 01 06 07 616263 06 00"); !reflect.DeepEqual(v, []any{"abc", "abc"}) {
+		t.Errorf("string reference: %v", v)
+	}
+	// 第二个元素引用第一个对象，引用表中0为数组本身
+	v := unmarshal3(t, "11 09 05 01 0A 0B 01 03 61 04 01 01 0A 02")
+	arr, _ := v.([]any)
+	if len(arr) != 2 || reflect.ValueOf(arr[0]).Pointer() != reflect.ValueOf(arr[1]).Pointer() {
+		t.Errorf("object reference: %v", v)
+	}
+	// 第二个对象引用第一个对象的类型描述，成员名也进入字符串引用表
+	if v := unmarshal3(t, "11 09 05 01 0A 13 05 5074 03 78 04 01 0A 01 04 02"); !reflect.DeepEqual(v, []any{map[string]any{"x": 1.0}, map[string]any{"x": 2.0}}) {
+		t.Errorf("traits reference: %v", v)
+	}
+	// 切换到AMF3时引用表重置
+	d := newAMFDecoder(unhex("11 06 07 616263 11 06 00"))
+	if v, err := d.Unmarshal(); err != nil || v != "abc" {
+		t.Fatalf("%v, %v", v, err)
+	}
+	if _, err := d.Unmarshal(); err == nil {
+		t.Error("string reference across avmplus switches")
+	}
+}
+
+func TestAMF3Traits(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want any
+	}{
+		{"anonymous dynamic", "11 0A 0B 01 03 61 06 03 62 01", map[string]any{"a": "b"}},
+		{"sealed", "11 0A 23 05 5074 03 78 03 79 04 01 04 02", map[string]any{"x": 1.0, "y": 2.0}},
+		{"sealed and dynamic", "11 0A 1B 01 03 61 04 01 03 62 04 02 01", map[string]any{"a": 1.0, "b": 2.0}},
+		{"ArrayCollection", "11 0A 07 43 " + hex.EncodeToString([]byte("flex.messaging.io.ArrayCollection")) + " 09 03 01 04 05", []any{5.0}},
+		{"ObjectProxy", "11 0A 07 3B " + hex.EncodeToString([]byte("flex.messaging.io.ObjectProxy")) + " 0A 0B 01 03 61 02 01", map[string]any{"a": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v := unmarshal3(t, tt.data); !reflect.DeepEqual(v, tt.want) {
+				t.Errorf("got %v", v)
+			}
+		})
+	}
+	if _, err := newAMFDecoder(unhex("11 0A 07 07 " + hex.EncodeToString([]byte("Foo")) + " 01")).Unmarshal(); err == nil {
+		t.Error("unknown externalizable class decoded")
+	}
+}
+
+func TestAMF3Types(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want any
+	}{
+		{"integer", "11 04 FF FF FF FF", -1.0},
+		{"max integer", "11 04 BF FF FF FF", float64(1<<28 - 1)},
+		{"double", "11 05 3FF8000000000000", 1.5},
+		{"date", "11 08 01 4276F5E66E800000", time.UnixMilli(1577836800000)},
+		{"xml", "11 0B 07 3C 61 3E", "<a>"},
+		{"array with associative part", "11 09 03 03 6B 04 01 01 04 02", map[string]any{"k": 1.0, "0": 2.0}},
+		{"ByteArray", "11 0C 07 010203", []byte{1, 2, 3}},
+		{"Vector.<int>", "11 0D 05 00 FFFFFFFF 00000001", []int32{-1, 1}},
+		{"Vector.<uint>", "11 0E 03 01 FFFFFFFF", []uint32{math.MaxUint32}},
+		{"Vector.<Number>", "11 0F 03 00 3FF8000000000000", []float64{1.5}},
+		{"Vector.<Object>", "11 10 05 00 01 06 03 61 04 01", []any{"a", 1.0}},
+		{"Dictionary", "11 11 05 00 06 03 6B 04 01 04 02 06 03 76", map[string]any{"k": 1.0, "2": "v"}},
+		{"Dictionary with object key", "11 11 03 00 0A 0B 01 01 03", map[string]any{"[object 0]": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := unmarshal3(t, tt.data)
+			if date, ok := tt.want.(time.Time); ok {
+				if !date.Equal(v.(time.Time)) {
+					t.Errorf("got %v", v)
+				}
+			} else if !reflect.DeepEqual(v, tt.want) {
+				t.Errorf("got %#v", v)
+			}
+		})
+	}
+}
+
+// 编码后再解析得到相同的值，重复的字符串使用引用
+func TestAMF3Encode(t *testing.T) {
+	value := map[string]any{
+		"name":  "abc",
+		"names": []any{"abc", "abc", nil, true, false},
+		"int":   int32(-5),
+		"uint":  uint64(1 << 30),
+		"float": float32(0.5),
+		"date":  time.UnixMilli(1577836800000),
+		"bytes": []byte{1, 2, 3},
+	}
+	var enc amf3Encoder
+	enc.encode(value)
+	if n := bytes.Count(enc.Buffer, []byte("abc")); n != 1 {
+		t.Errorf("abc encoded %d times", n)
+	}
+	v, err := newAMFDecoder(enc.Buffer).unmarshal3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := v.(map[string]any)
+	if !got["date"].(time.Time).Equal(value["date"].(time.Time)) {
+		t.Errorf("date %v", got["date"])
+	}
+	delete(got, "date")
+	want := map[string]any{
+		"name":  "abc",
+		"names": []any{"abc", "abc", nil, true, false},
+		"int":   -5.0,
+		"uint":  float64(1 << 30),
+		"float": 0.5,
+		"bytes": []byte{1, 2, 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v", got)
+	}
+}
+
+// 类型17的命令消息以格式字节开头，对象以avmplus标记切换为AMF3
+func TestAMF3Command(t *testing.T) {
+	body := unhex("00 02 0007 " + hex.EncodeToString([]byte("connect")) + " 00 3FF0000000000000" +
+		" 11 0A 0B 01 07 617070 06 09 6C697665 1D 6F626A656374456E636F64696E67 04 03 01")
+	chunk := &Chunk{ChunkHeader: ChunkHeader{MessageTypeID: RTMP_MSG_AMF3_COMMAND}}
+	if err := GetRtmpMessage(chunk, body); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := chunk.MsgData.(*CallMessage)
+	if !ok {
+		t.Fatalf("got %T", chunk.MsgData)
+	}
+	if m.CommandName != "connect" || m.TransactionId != 1 || m.Object["app"] != "live" || m.Object["objectEncoding"] != 3.0 {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestAMFMalicious(t *testing.T) {
+	var many amf3Encoder
+	many.writeU29(maxAMFReferences<<1 | 1)
+	manyRefs := "11 09 " + hex.EncodeToString(many.Buffer) + " 01 " + strings.Repeat("0C01", maxAMFReferences)
+	// 每个数组两次引用前一个数组，展开后的值的个数按2的幂增长
+	expanding := "11 10 33 00 01 090101"
+	for i := 1; i < 25; i++ {
+		expanding += fmt.Sprintf("090501 09%02X 09%02X", i<<1, i<<1)
+	}
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"truncated number", "00 3FF0", errAMFTruncated},
+		{"string longer than data", "02 0005 6162", errAMFTruncated},
+		{"truncated U29", "11 04 FF FF", errAMFTruncated},
+		{"array count larger than data", "11 09 FF FF FF FF 01", errAMFTruncated},
+		{"strict array count larger than data", "0A FFFFFFFF", errAMFTruncated},
+		{"sealed count larger than data", "11 0A FF FF FF F3 01", errAMFTruncated},
+		{"string reference out of range", "11 06 02", nil},
+		{"object reference out of range", "11 0A 02", nil},
+		{"traits reference out of range", "11 0A 05", nil},
+		{"amf0 reference out of range", "07 0001", nil},
+		{"amf3 array containing itself", "11 09 03 01 09 00", errAMFCyclicRef},
+		{"amf3 object containing itself", "11 0A 0B 01 03 61 0A 00 01", errAMFCyclicRef},
+		{"amf0 object containing itself", "03 0001 61 07 0000 0000 09", errAMFCyclicRef},
+		{"nested amf0 arrays", strings.Repeat("0A00000001", maxAMFDepth) + "05", errAMFTooDeep},
+		{"nested amf3 arrays", "11" + strings.Repeat("090301", maxAMFDepth) + "01", errAMFTooDeep},
+		{"too many references", manyRefs, errAMFTooManyRefs},
+		{"references expanding to too many values", expanding, errAMFTooManyValues},
+		{"too many elements", "11 0D 80 C0 80 03 00" + strings.Repeat("00000000", maxAMFElements+1), errAMFTooManyElements},
+		{"unknown amf0 type", "0E", nil},
+		{"unknown amf3 type", "11 13", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newAMFDecoder(unhex(tt.data)).Unmarshal()
+			if err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+	// 截断在任意位置都返回错误
+	valid := unhex("11 09 07 03 6B 0A 13 05 5074 03 78 04 01 01 06 07 616263 0D 03 00 00000001 11 03 00 04 01 0C 03 FF")
+	if _, err := newAMFDecoder(valid).Unmarshal(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range valid {
+		if _, err := newAMFDecoder(valid[:i]).Unmarshal(); err == nil {
+			t.Errorf("truncated at %d decoded", i)
+		}
+	}
+}
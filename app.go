@@ -0,0 +1,97 @@
+package rtmp
+
+import (
+	"m7s.live/engine/v4/config"
+)
+
+const (
+	AllowPublish = "publish"
+	AllowPlay    = "play"
+)
+
+// AppConfig 单个应用的配置，未配置的项使用全局配置
+type AppConfig struct {
+	ChunkSize   int               `desc:"分片大小"`
+	KeepAlive   *bool             `desc:"保持连接，流断开不关闭连接"`
+	Publish     *config.Publish   `desc:"推流配置"`
+	Subscribe   *config.Subscribe `desc:"订阅配置"`
+	PublishAuth *AuthConfig       `desc:"推流鉴权"`
+	PlayAuth    *AuthConfig       `desc:"播放鉴权"`
+	Allow       string            `desc:"允许的操作，publish：只允许推流，play：只允许播放，为空则都允许"`
+	prefix      string
+}
+
+// appPath 加上vhost前缀的应用名，用于组成streamPath
+func (app *AppConfig) appPath(appName string) string {
+	if app.prefix == "" {
+		return appName
+	}
+	return app.prefix + "/" + appName
+}
+
+func (app *AppConfig) CanPublish() bool {
+	return app.Allow == "" || app.Allow == AllowPublish
+}
+
+func (app *AppConfig) CanPlay() bool {
+	return app.Allow == "" || app.Allow == AllowPlay
+}
+
+func (app *AppConfig) inherit(c *AppConfig) {
+	if app.ChunkSize == 0 {
+		app.ChunkSize = c.ChunkSize
+	}
+	if app.KeepAlive == nil {
+		app.KeepAlive = c.KeepAlive
+	}
+	if app.Publish == nil {
+		app.Publish = c.Publish
+	}
+	if app.Subscribe == nil {
+		app.Subscribe = c.Subscribe
+	}
+	if app.PublishAuth == nil {
+		app.PublishAuth = c.PublishAuth
+	}
+	if app.PlayAuth == nil {
+		app.PlayAuth = c.PlayAuth
+	}
+	if app.Allow == "" {
+		app.Allow = c.Allow
+	}
+}
+
+// defaultApp 全局配置
+func (c *RTMPConfig) defaultApp() *AppConfig {
+	return &AppConfig{
+		ChunkSize:   c.ChunkSize,
+		KeepAlive:   &c.KeepAlive,
+		Publish:     &c.Publish,
+		Subscribe:   &c.Subscribe,
+		PublishAuth: &c.PublishAuth,
+		PlayAuth:    &c.PlayAuth,
+	}
+}
+
+// findApp 查找应用配置，依次使用vhost、vhost的默认配置和全局配置，配置了apps但没有匹配项时返回nil。
+// 没有配置的vhost（例如用IP或者别名连接）都使用全局的应用配置和没有前缀的streamPath，它们之间共享流和共享对象
+func (c *RTMPConfig) findApp(vhost, name string) *AppConfig {
+	app, ok := AppConfig{}, true
+	v, hasVhost := matchPattern(c.Vhosts, vhost)
+	if hasVhost && len(v.Apps) > 0 {
+		app, ok = matchPattern(v.Apps, name)
+	} else if len(c.Apps) > 0 {
+		app, ok = matchPattern(c.Apps, name)
+	}
+	if !ok {
+		return nil
+	}
+	if hasVhost {
+		app.inherit(&v.Default)
+		if app.prefix = v.Prefix; app.prefix == "" {
+			app.prefix = vhost
+		}
+	}
+	app.inherit(c.defaultApp())
+	return &app
+}
@@ -0,0 +1,51 @@
+package rtmp
+
+import "testing"
+
+func TestFindApp(t *testing.T) {
+	keepAlive := true
+	c := &RTMPConfig{ChunkSize: 65535}
+	if app := c.findApp("", "any"); app == nil || app.ChunkSize != 65535 || app.PublishAuth != &c.PublishAuth || app.appPath("any") != "any" {
+		t.Fatalf("without apps: %+v", app)
+	}
+	c.Apps = map[string]AppConfig{
+		"live":   {},
+		"ingest": {ChunkSize: 4096, KeepAlive: &keepAlive, Allow: AllowPublish, PlayAuth: &AuthConfig{Secret: "s"}},
+		"vod*":   {Allow: AllowPlay},
+		"v*":     {ChunkSize: 1024},
+	}
+	tests := []struct {
+		name      string
+		chunkSize int
+		allow     string
+	}{
+		{"live", 65535, ""},
+		{"ingest", 4096, AllowPublish},
+		{"vod1", 65535, AllowPlay}, // vod*比v*长
+		{"video", 1024, ""},
+	}
+	for _, tt := range tests {
+		app := c.findApp("", tt.name)
+		if app == nil {
+			t.Fatalf("%s: not found", tt.name)
+		}
+		if app.ChunkSize != tt.chunkSize || app.Allow != tt.allow {
+			t.Errorf("%s: chunkSize %d, allow %q", tt.name, app.ChunkSize, app.Allow)
+		}
+	}
+	if c.findApp("", "other") != nil {
+		t.Error("app not in apps accepted")
+	}
+	ingest := c.findApp("", "ingest")
+	if !*ingest.KeepAlive || ingest.PublishAuth != &c.PublishAuth || ingest.PlayAuth.Secret != "s" || ingest.Publish != &c.Publish {
+		t.Errorf("ingest inherited %+v", ingest)
+	}
+	if ingest.CanPlay() || !ingest.CanPublish() {
+		t.Error("ingest should only allow publish")
+	}
+	// 修改返回的配置不影响之后的查找
+	ingest.ChunkSize = 1
+	if c.findApp("", "ingest").ChunkSize != 4096 {
+		t.Error("findApp returned shared config")
+	}
+}
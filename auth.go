@@ -0,0 +1,319 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConnectInfo connect命令携带的客户端信息
+type ConnectInfo struct {
+	App        string
+	TcUrl      string
+	Object     map[string]any
+	Args       url.Values // tcUrl中携带的参数
+	RemoteAddr string
+	SessionID  string
+	Vhost      string // tcUrl中的vhost参数，没有则为tcUrl的host
+}
+
+func newConnectInfo(object map[string]any, remoteAddr string) *ConnectInfo {
+	id := make([]byte, 8)
+	rand.Read(id)
+	info := &ConnectInfo{
+		Object:     object,
+		RemoteAddr: remoteAddr,
+		SessionID:  hex.EncodeToString(id),
+	}
+	info.App, _ = object["app"].(string)
+	info.TcUrl, _ = object["tcUrl"].(string)
+	if u, err := url.Parse(info.TcUrl); err == nil {
+		info.Args = u.Query()
+		if info.Vhost = info.Args.Get("vhost"); info.Vhost == "" {
+			info.Vhost = u.Hostname()
+		}
+	}
+	return info
+}
+
+// IP 客户端IP
+func (info *ConnectInfo) IP() string {
+	host, _, err := net.SplitHostPort(info.RemoteAddr)
+	if err != nil {
+		return info.RemoteAddr
+	}
+	return host
+}
+
+// StreamInfo publish或play命令携带的流信息
+type StreamInfo struct {
+	*ConnectInfo
+	StreamPath string
+	StreamName string     // 不含参数的流名称
+	Args       url.Values // 流名称中携带的参数
+}
+
+// newStreamInfo 解析publish或play中的流名称，name可以带有参数，appPath为streamPath中流名称之前的部分
+func newStreamInfo(connectInfo *ConnectInfo, appPath, name string) *StreamInfo {
+	if connectInfo == nil {
+		connectInfo = &ConnectInfo{}
+	}
+	streamName, rawQuery, _ := strings.Cut(name, "?")
+	args, _ := url.ParseQuery(rawQuery)
+	return &StreamInfo{connectInfo, appPath + "/" + streamName, streamName, args}
+}
+
+// Get 先从流名称参数中查找，再从tcUrl参数中查找
+func (info *StreamInfo) Get(key string) string {
+	if v := info.Args.Get(key); v != "" {
+		return v
+	}
+	return info.ConnectInfo.Args.Get(key)
+}
+
+// Authorizer 推流鉴权，返回的错误信息会作为description发送给客户端
+type Authorizer interface {
+	AuthConnect(*ConnectInfo) error
+	AuthPublish(*StreamInfo) error
+}
+
+// PlayAuthorizer 播放鉴权
+type PlayAuthorizer interface {
+	AuthConnect(*ConnectInfo) error
+	AuthPlay(*StreamInfo) error
+}
+
+var authorizers []Authorizer
+var playAuthorizers []PlayAuthorizer
+
+// AddAuthorizer 注册自定义的推流鉴权，在内置鉴权之后执行
+func AddAuthorizer(a Authorizer) {
+	authorizers = append(authorizers, a)
+}
+
+// AddPlayAuthorizer 注册自定义的播放鉴权，在内置鉴权之后执行
+func AddPlayAuthorizer(a PlayAuthorizer) {
+	playAuthorizers = append(playAuthorizers, a)
+}
+
+type AuthConfig struct {
+	Keys      map[string]string `desc:"静态密钥，key为streamPath（*表示所有流），value为密钥"`
+	KeyArg    string            `desc:"静态密钥参数名，默认key"`
+	Secret    string            `desc:"签名密钥，为空则不校验签名"`
+	SignArg   string            `desc:"签名参数名，默认sign"`
+	ExpireArg string            `desc:"过期时间参数名（unix秒），默认expire"`
+	BindIP    bool              `desc:"签名是否绑定客户端IP"`
+}
+
+// builtinAuthorizer 内置鉴权同时支持推流和播放
+type builtinAuthorizer interface {
+	Authorizer
+	AuthPlay(*StreamInfo) error
+}
+
+func (c *AuthConfig) builtins() (list []builtinAuthorizer) {
+	if len(c.Keys) > 0 {
+		list = append(list, &StaticKeyAuthorizer{c.Keys, argName(c.KeyArg, "key")})
+	}
+	if c.Secret != "" {
+		list = append(list, &SignedURLAuthorizer{
+			Secret:    c.Secret,
+			SignArg:   argName(c.SignArg, "sign"),
+			ExpireArg: argName(c.ExpireArg, "expire"),
+			BindIP:    c.BindIP,
+		})
+	}
+	return
+}
+
+func (c *AuthConfig) AuthConnect(info *ConnectInfo) error {
+	for _, a := range c.builtins() {
+		if err := a.AuthConnect(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *AuthConfig) AuthPublish(info *StreamInfo) error {
+	for _, a := range c.builtins() {
+		if err := a.AuthPublish(info); err != nil {
+			return err
+		}
+	}
+	for _, a := range authorizers {
+		if err := a.AuthPublish(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *AuthConfig) AuthPlay(info *StreamInfo) error {
+	for _, a := range c.builtins() {
+		if err := a.AuthPlay(info); err != nil {
+			return err
+		}
+	}
+	for _, a := range playAuthorizers {
+		if err := a.AuthPlay(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectPublish 推流的connect鉴权：内置鉴权和所有注册的Authorizer
+func (c *AuthConfig) connectPublish(info *ConnectInfo) error {
+	if err := c.AuthConnect(info); err != nil {
+		return err
+	}
+	for _, a := range authorizers {
+		if err := a.AuthConnect(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectPlay 播放的connect鉴权：内置鉴权和所有注册的PlayAuthorizer
+func (c *AuthConfig) connectPlay(info *ConnectInfo) error {
+	if err := c.AuthConnect(info); err != nil {
+		return err
+	}
+	for _, a := range playAuthorizers {
+		if err := a.AuthConnect(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeConnect 在connect时执行。这时还不知道客户端要推流还是播放，推流和播放的connect鉴权都不通过才拒绝，
+// publish和play时再分别执行对应的connect鉴权
+func authorizeConnect(publish, play *AuthConfig, info *ConnectInfo) error {
+	err := publish.connectPublish(info)
+	if err == nil || play.connectPlay(info) == nil {
+		return nil
+	}
+	return err
+}
+
+// authorizePublish 在publish时执行推流的connect鉴权和publish鉴权
+func (c *AuthConfig) authorizePublish(info *StreamInfo) error {
+	if err := c.connectPublish(info.ConnectInfo); err != nil {
+		return err
+	}
+	return c.AuthPublish(info)
+}
+
+// authorizePlay 在play时执行播放的connect鉴权和play鉴权
+func (c *AuthConfig) authorizePlay(info *StreamInfo) error {
+	if err := c.connectPlay(info.ConnectInfo); err != nil {
+		return err
+	}
+	return c.AuthPlay(info)
+}
+
+func argName(name, def string) string {
+	if name == "" {
+		return def
+	}
+	return name
+}
+
+// StaticKeyAuthorizer 按streamPath校验固定的推流密钥
+type StaticKeyAuthorizer struct {
+	Keys   map[string]string
+	KeyArg string
+}
+
+func (a *StaticKeyAuthorizer) AuthConnect(*ConnectInfo) error {
+	return nil
+}
+
+func (a *StaticKeyAuthorizer) AuthPublish(info *StreamInfo) error {
+	key, ok := a.Keys[info.StreamPath]
+	if !ok {
+		if key, ok = a.Keys["*"]; !ok {
+			return errors.New("no key for " + info.StreamPath)
+		}
+	}
+	if !hmac.Equal([]byte(info.Get(a.KeyArg)), []byte(key)) {
+		return errors.New("invalid key")
+	}
+	return nil
+}
+
+func (a *StaticKeyAuthorizer) AuthPlay(info *StreamInfo) error {
+	return a.AuthPublish(info)
+}
+
+// SignedURLAuthorizer 校验带过期时间的HMAC签名，签名方法见Sign
+type SignedURLAuthorizer struct {
+	Secret    string
+	SignArg   string
+	ExpireArg string
+	BindIP    bool
+}
+
+// Sign 计算streamPath在expire（unix秒）之前有效的签名，以hex编码
+func Sign(secret, streamPath string, expire int64) string {
+	return SignIP(secret, streamPath, expire, "")
+}
+
+// SignIP 与Sign相同，ip不为空时签名只对该客户端IP有效
+func SignIP(secret, streamPath string, expire int64, ip string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(streamPath + ":" + strconv.FormatInt(expire, 10)))
+	if ip != "" {
+		mac.Write([]byte(":" + ip))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkExpire(value string) (int64, error) {
+	expire, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid expire")
+	}
+	if time.Now().Unix() > expire {
+		return 0, errors.New("token expired")
+	}
+	return expire, nil
+}
+
+// AuthConnect tcUrl中携带了过期时间时提前拒绝已过期的连接
+func (a *SignedURLAuthorizer) AuthConnect(info *ConnectInfo) error {
+	if v := info.Args.Get(a.ExpireArg); v != "" {
+		_, err := checkExpire(v)
+		return err
+	}
+	return nil
+}
+
+func (a *SignedURLAuthorizer) AuthPublish(info *StreamInfo) error {
+	expire, err := checkExpire(info.Get(a.ExpireArg))
+	if err != nil {
+		return err
+	}
+	var ip string
+	if a.BindIP {
+		ip = info.IP()
+	}
+	if !hmac.Equal([]byte(info.Get(a.SignArg)), []byte(SignIP(a.Secret, info.StreamPath, expire, ip))) {
+		return errors.New("invalid sign")
+	}
+	return nil
+}
+
+func (a *SignedURLAuthorizer) AuthPlay(info *StreamInfo) error {
+	return a.AuthPublish(info)
+}
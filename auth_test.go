@@ -0,0 +1,177 @@
+package rtmp
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testAuthorizer 同时实现Authorizer和PlayAuthorizer，返回固定的结果
+type testAuthorizer struct {
+	connect, stream error
+}
+
+func (a testAuthorizer) AuthConnect(*ConnectInfo) error { return a.connect }
+func (a testAuthorizer) AuthPublish(*StreamInfo) error  { return a.stream }
+func (a testAuthorizer) AuthPlay(*StreamInfo) error     { return a.stream }
+
+// setAuthorizers 替换注册的鉴权，测试结束后恢复
+func setAuthorizers(t *testing.T, publish []Authorizer, play []PlayAuthorizer) {
+	oldPublish, oldPlay := authorizers, playAuthorizers
+	authorizers, playAuthorizers = publish, play
+	t.Cleanup(func() {
+		authorizers, playAuthorizers = oldPublish, oldPlay
+	})
+}
+
+func TestAuthorizeConnect(t *testing.T) {
+	rejected := errors.New("rejected")
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	signed := &AuthConfig{Secret: "secret"}
+	tests := []struct {
+		name          string
+		publish, play *AuthConfig
+		authorizers   []Authorizer
+		playAuth      []PlayAuthorizer
+		tcUrl         string
+		ok            bool
+	}{
+		{"no auth", &AuthConfig{}, &AuthConfig{}, nil, nil, "rtmp://host/live", true},
+		{"expired token for both", signed, signed, nil, nil, "rtmp://host/live?expire=" + expired, false},
+		{"expired token only checked by publish", signed, &AuthConfig{}, nil, nil, "rtmp://host/live?expire=" + expired, true},
+		{"registered authorizer rejects, play accepts", &AuthConfig{}, &AuthConfig{}, []Authorizer{testAuthorizer{connect: rejected}}, nil, "rtmp://host/live", true},
+		{"both registered authorizers reject", &AuthConfig{}, &AuthConfig{},
+			[]Authorizer{testAuthorizer{connect: rejected}}, []PlayAuthorizer{testAuthorizer{connect: rejected}}, "rtmp://host/live", false},
+		{"one of several play authorizers rejects", signed, &AuthConfig{},
+			nil, []PlayAuthorizer{testAuthorizer{}, testAuthorizer{connect: rejected}}, "rtmp://host/live?expire=" + expired, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAuthorizers(t, tt.authorizers, tt.playAuth)
+			info := newConnectInfo(map[string]any{"app": "live", "tcUrl": tt.tcUrl}, "10.0.0.1:5000")
+			if err := authorizeConnect(tt.publish, tt.play, info); (err == nil) != tt.ok {
+				t.Fatalf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestStaticKeyAuthorizer(t *testing.T) {
+	a := &StaticKeyAuthorizer{Keys: map[string]string{"live/a": "ka", "*": "any"}, KeyArg: "key"}
+	only := &StaticKeyAuthorizer{Keys: map[string]string{"live/a": "ka"}, KeyArg: "key"}
+	tests := []struct {
+		name string
+		a    *StaticKeyAuthorizer
+		tc   string
+		play string
+		ok   bool
+	}{
+		{"stream key", a, "", "a?key=ka", true},
+		{"wrong stream key", a, "", "a?key=any", false},
+		{"wildcard key", a, "", "b?key=any", true},
+		{"missing key", a, "", "b", false},
+		{"key in tcUrl", a, "?key=ka", "a", true},
+		{"stream name overrides tcUrl", a, "?key=ka", "a?key=bad", false},
+		{"no key for stream", only, "", "b?key=ka", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connect := newConnectInfo(map[string]any{"app": "live", "tcUrl": "rtmp://host/live" + tt.tc}, "10.0.0.1:5000")
+			info := newStreamInfo(connect, "live", tt.play)
+			if err := tt.a.AuthPublish(info); (err == nil) != tt.ok {
+				t.Errorf("publish: err = %v", err)
+			}
+			if err := tt.a.AuthPlay(info); (err == nil) != tt.ok {
+				t.Errorf("play: err = %v", err)
+			}
+		})
+	}
+}
+
+func TestSignedURLAuthorizer(t *testing.T) {
+	now := time.Now().Unix()
+	sign := func(expire int64, ip string) string {
+		return "sign=" + SignIP("secret", "live/test", expire, ip) + "&expire=" + strconv.FormatInt(expire, 10)
+	}
+	tests := []struct {
+		name       string
+		bindIP     bool
+		remoteAddr string
+		tc         string
+		play       string
+		ok         bool
+	}{
+		{"valid", false, "10.0.0.1:5000", "", "test?" + sign(now+60, ""), true},
+		{"Sign matches SignIP without ip", false, "10.0.0.1:5000", "", "test?sign=" + Sign("secret", "live/test", now+60) + "&expire=" + strconv.FormatInt(now+60, 10), true},
+		{"expires next second", false, "10.0.0.1:5000", "", "test?" + sign(now+1, ""), true},
+		{"expired a second ago", false, "10.0.0.1:5000", "", "test?" + sign(now-1, ""), false},
+		{"expire changed", false, "10.0.0.1:5000", "", "test?sign=" + SignIP("secret", "live/test", now+60, "") + "&expire=" + strconv.FormatInt(now+3600, 10), false},
+		{"invalid expire", false, "10.0.0.1:5000", "", "test?sign=x&expire=soon", false},
+		{"wrong secret", false, "10.0.0.1:5000", "", "test?sign=" + SignIP("other", "live/test", now+60, "") + "&expire=" + strconv.FormatInt(now+60, 10), false},
+		{"signed for another stream", false, "10.0.0.1:5000", "", "other?" + sign(now+60, ""), false},
+		{"token in tcUrl", false, "10.0.0.1:5000", "?" + sign(now+60, ""), "test", true},
+		{"bound ip with port", true, "10.0.0.1:5000", "", "test?" + sign(now+60, "10.0.0.1"), true},
+		{"bound ip without port", true, "10.0.0.1", "", "test?" + sign(now+60, "10.0.0.1"), true},
+		{"bound ipv6 with port", true, "[::1]:5000", "", "test?" + sign(now+60, "::1"), true},
+		{"bound to another ip", true, "10.0.0.2:5000", "", "test?" + sign(now+60, "10.0.0.1"), false},
+		{"ip binding required", true, "10.0.0.1:5000", "", "test?" + sign(now+60, ""), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &SignedURLAuthorizer{Secret: "secret", SignArg: "sign", ExpireArg: "expire", BindIP: tt.bindIP}
+			connect := newConnectInfo(map[string]any{"app": "live", "tcUrl": "rtmp://host/live" + tt.tc}, tt.remoteAddr)
+			if err := a.AuthPlay(newStreamInfo(connect, "live", tt.play)); (err == nil) != tt.ok {
+				t.Fatalf("err = %v", err)
+			}
+		})
+	}
+}
+
+// 流名称中的参数只用于鉴权，不属于streamPath
+func TestStreamInfoPath(t *testing.T) {
+	connect := newConnectInfo(map[string]any{"app": "live", "tcUrl": "rtmp://host/live?token=t1&vhost=v"}, "10.0.0.1:5000")
+	info := newStreamInfo(connect, "v/live", "test?token=t2&key=k")
+	if info.StreamPath != "v/live/test" || info.StreamName != "test" {
+		t.Errorf("streamPath %q, streamName %q", info.StreamPath, info.StreamName)
+	}
+	if info.Get("token") != "t2" || info.Get("vhost") != "v" || info.Get("key") != "k" {
+		t.Errorf("args %v, tcUrl args %v", info.Args, info.ConnectInfo.Args)
+	}
+	if info := newStreamInfo(nil, "live", "test?"); info.StreamPath != "live/test" || info.Get("key") != "" {
+		t.Errorf("streamPath %q", info.StreamPath)
+	}
+}
+
+// 内置鉴权之后依次执行注册的鉴权，任意一个失败就拒绝
+func TestAuthorizeWithRegistered(t *testing.T) {
+	rejected := errors.New("rejected")
+	c := &AuthConfig{Keys: map[string]string{"*": "k"}}
+	connect := newConnectInfo(map[string]any{"app": "live", "tcUrl": "rtmp://host/live"}, "10.0.0.1:5000")
+	tests := []struct {
+		name    string
+		stream  string
+		publish []Authorizer
+		play    []PlayAuthorizer
+		err     error // nil表示通过，errAny表示内置鉴权拒绝
+	}{
+		{"builtin and registered accept", "test?key=k", []Authorizer{testAuthorizer{}}, []PlayAuthorizer{testAuthorizer{}}, nil},
+		{"builtin rejects first", "test?key=bad", []Authorizer{testAuthorizer{stream: rejected}}, []PlayAuthorizer{testAuthorizer{stream: rejected}}, errAny},
+		{"registered rejects stream", "test?key=k", []Authorizer{testAuthorizer{}, testAuthorizer{stream: rejected}}, []PlayAuthorizer{testAuthorizer{stream: rejected}}, rejected},
+		{"registered rejects connect", "test?key=k", []Authorizer{testAuthorizer{connect: rejected}}, []PlayAuthorizer{testAuthorizer{connect: rejected}}, rejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAuthorizers(t, tt.publish, tt.play)
+			info := newStreamInfo(connect, "live", tt.stream)
+			for op, err := range map[string]error{"publish": c.authorizePublish(info), "play": c.authorizePlay(info)} {
+				switch {
+				case tt.err == nil && err != nil, tt.err == errAny && (err == nil || err == rejected):
+					t.Errorf("%s: err = %v", op, err)
+				case tt.err != nil && tt.err != errAny && err != tt.err:
+					t.Errorf("%s: err = %v, want %v", op, err, tt.err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+// 播放参数captions的取值，不指定时原样转发
+const (
+	CaptionModeSEI         = "sei"         // onCaptionInfo转换为H264的SEI插入视频帧
+	CaptionModeCaptionInfo = "captioninfo" // 视频帧中的SEI另外以onCaptionInfo发送
+)
+
+const (
+	naluTypeSEI        = 6
+	naluTypeAUD        = 9
+	seiTypeUserDataT35 = 4
+)
+
+// CEA-708的SEI负载以ITU-T T.35的国家码、厂商码和ATSC的标识开头
+var captionT35Header = []byte{0xB5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03}
+
+// maxCaptionData 发布者上保留的最近的字幕数据的数量
+const maxCaptionData = 32
+
+// CaptionData 推流端发送的一段字幕，608为cc_data中的字节对，708为T.35负载（JSON中为Base64）
+type CaptionData struct {
+	Timestamp uint32 `json:"timestamp"` // 流中的时间戳，毫秒
+	Type      string `json:"type"`      // 608或708
+	Source    string `json:"source"`    // sei或captionInfo
+	Data      []byte `json:"data"`
+}
+
+// CaptionInfo 流中检测到的字幕，推流端通过SEI、onCaptionInfo或者onTextData发送
+type CaptionInfo struct {
+	SEI         bool          `json:"sei"`         // H264的SEI中有CEA-608/708字幕
+	CaptionInfo bool          `json:"captionInfo"` // onCaptionInfo数据消息
+	TextData    bool          `json:"textData"`    // onTextData数据消息
+	Text        string        `json:"text,omitempty"`
+	Updated     time.Time     `json:"updated"`
+	Recent      []CaptionData `json:"recent,omitempty"` // 最近的字幕数据，相同的数据只记录一次
+}
+
+// captionState 附加在发布者上的字幕信息，重新发布时随新的发布者一起替换
+type captionState struct {
+	sync.Mutex
+	info           CaptionInfo
+	naluLengthSize int // 从AVC序列头中读取，0表示还没有收到序列头
+}
+
+// captionPublisher 保存了字幕信息的发布者
+type captionPublisher interface {
+	captionInfo() *CaptionInfo
+}
+
+// captionInfo 返回字幕信息的副本，还没有检测到字幕时返回nil
+func (r *RTMPReceiver) captionInfo() *CaptionInfo {
+	r.captions.Lock()
+	defer r.captions.Unlock()
+	if r.captions.info.Updated.IsZero() {
+		return nil
+	}
+	info := r.captions.info
+	info.Recent = append([]CaptionData(nil), info.Recent...)
+	return &info
+}
+
+func findCaptionInfo(streamPath string) *CaptionInfo {
+	if s := Streams.Get(streamPath); s != nil {
+		if p, ok := s.Publisher.(captionPublisher); ok {
+			return p.captionInfo()
+		}
+	}
+	return nil
+}
+
+// setCaptionForm 记录字幕的形式，第一次出现时输出日志，调用前需要加锁
+func (r *RTMPReceiver) setCaptionForm(form string, flag *bool) {
+	if !*flag {
+		*flag = true
+		r.captions.info.Updated = time.Now()
+		r.Info("caption", zap.String("form", form))
+	}
+}
+
+// addCaption 记录字幕数据，与最近一次相同时（例如608的填充字节）不记录
+func (r *RTMPReceiver) addCaption(ts uint32, typ, source string, data []byte) {
+	r.captions.Lock()
+	defer r.captions.Unlock()
+	info := &r.captions.info
+	if source == "sei" {
+		r.setCaptionForm(source, &info.SEI)
+	} else {
+		r.setCaptionForm(source, &info.CaptionInfo)
+	}
+	if n := len(info.Recent); n > 0 && info.Recent[n-1].Type == typ && bytes.Equal(info.Recent[n-1].Data, data) {
+		return
+	}
+	if len(info.Recent) == maxCaptionData {
+		copy(info.Recent, info.Recent[1:])
+		info.Recent = info.Recent[:maxCaptionData-1]
+	}
+	info.Recent = append(info.Recent, CaptionData{ts, typ, source, data})
+	info.Updated = time.Now()
+}
+
+// detectCaptionData 记录onCaptionInfo和onTextData
+func (r *RTMPReceiver) detectCaptionData(ts uint32, handler string, args []any) {
+	switch handler {
+	case "onCaptionInfo":
+		obj, _ := firstArg(args).(map[string]any)
+		typ, _ := obj["type"].(string)
+		s, _ := obj["data"].(string)
+		if data, err := base64.StdEncoding.DecodeString(s); err == nil && len(data) > 0 && (typ == "608" || typ == "708") {
+			r.addCaption(ts, typ, "captionInfo", data)
+		}
+	case "onTextData":
+		r.captions.Lock()
+		defer r.captions.Unlock()
+		r.setCaptionForm(handler, &r.captions.info.TextData)
+		if obj, ok := firstArg(args).(map[string]any); ok {
+			if text, _ := obj["text"].(string); text != r.captions.info.Text {
+				r.captions.info.Text = text
+				r.captions.info.Updated = time.Now()
+			}
+		}
+	}
+}
+
+// detectCaptionSEI 记录H264视频帧中的字幕SEI，序列头中读取NALU长度的字节数
+func (r *RTMPReceiver) detectCaptionSEI(ts uint32, avcc *util.BLL) {
+	if avcc.ByteLength < 10 || codec.VideoCodecID(avcc.GetByte(0)&0x0F) != codec.CodecID_H264 {
+		return
+	}
+	if avcc.GetByte(1) == 0 {
+		r.captions.Lock()
+		r.captions.naluLengthSize = int(avcc.GetByte(9)&3) + 1
+		r.captions.Unlock()
+		return
+	}
+	r.captions.Lock()
+	lengthSize := r.captions.naluLengthSize
+	r.captions.Unlock()
+	if payload := captionPayload(avcc, lengthSize); payload != nil {
+		r.addCaption(ts, "708", "sei", payload)
+	}
+}
+
+// avcNALULengthSize AVC序列头（旧格式的视频标签）中NALU长度的字节数
+func avcNALULengthSize(seqHead []byte) int {
+	if len(seqHead) < 10 || codec.VideoCodecID(seqHead[0]&0x0F) != codec.CodecID_H264 {
+		return 4
+	}
+	return int(seqHead[9]&3) + 1
+}
+
+// captionPayload 直接在视频帧上查找SEI中的CEA-708 T.35负载，只复制SEI NALU。
+// lengthSize为NALU长度的字节数，为0时使用4
+func captionPayload(avcc *util.BLL, lengthSize int) []byte {
+	if lengthSize == 0 {
+		lengthSize = 4
+	}
+	if avcc.ByteLength < 5+lengthSize || codec.VideoCodecID(avcc.GetByte(0)&0x0F) != codec.CodecID_H264 || avcc.GetByte(1) != 1 {
+		return nil
+	}
+	for i := 5; i+lengthSize < avcc.ByteLength; {
+		size := int(avcc.GetUintN(i, lengthSize))
+		if i += lengthSize; size <= 0 || i+size > avcc.ByteLength {
+			return nil
+		}
+		if avcc.GetByte(i)&0x1F == naluTypeSEI {
+			nalu := make([]byte, size)
+			for j := range nalu {
+				nalu[j] = avcc.GetByte(i + j)
+			}
+			if payload := seiCaptionPayload(nalu); payload != nil {
+				return payload
+			}
+		}
+		i += size
+	}
+	return nil
+}
+
+// seiCaptionPayload 从SEI NALU中找出CEA-708的T.35负载
+func seiCaptionPayload(nalu []byte) []byte {
+	rbsp := removeEmulationPrevention(nalu[1:])
+	for len(rbsp) > 2 && rbsp[0] != 0x80 {
+		var payloadType, payloadSize int
+		for len(rbsp) > 0 && rbsp[0] == 0xFF {
+			payloadType += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			return nil
+		}
+		payloadType, rbsp = payloadType+int(rbsp[0]), rbsp[1:]
+		for len(rbsp) > 0 && rbsp[0] == 0xFF {
+			payloadSize += 255
+			rbsp = rbsp[1:]
+		}
+		if len(rbsp) == 0 {
+			return nil
+		}
+		payloadSize, rbsp = payloadSize+int(rbsp[0]), rbsp[1:]
+		if payloadSize > len(rbsp) {
+			return nil
+		}
+		if payloadType == seiTypeUserDataT35 && bytes.HasPrefix(rbsp[:payloadSize], captionT35Header) {
+			return rbsp[:payloadSize]
+		}
+		rbsp = rbsp[payloadSize:]
+	}
+	return nil
+}
+
+func removeEmulationPrevention(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func addEmulationPrevention(data []byte) []byte {
+	out := make([]byte, 0, len(data)+len(data)/64)
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// captionSEI 把T.35负载封装为带lengthSize字节长度的SEI NALU
+func captionSEI(payload []byte, lengthSize int) []byte {
+	rbsp := []byte{seiTypeUserDataT35}
+	size := len(payload)
+	for ; size >= 255; size -= 255 {
+		rbsp = append(rbsp, 0xFF)
+	}
+	rbsp = append(rbsp, byte(size))
+	rbsp = append(rbsp, payload...)
+	rbsp = append(rbsp, 0x80)
+	nalu := append([]byte{naluTypeSEI}, addEmulationPrevention(rbsp)...)
+	head := make([]byte, lengthSize)
+	for i, n := lengthSize-1, len(nalu); i >= 0; i, n = i-1, n>>8 {
+		head[i] = byte(n)
+	}
+	return append(head, nalu...)
+}
+
+// insertSEI 在视频帧的第一个NALU之前（有AUD时在AUD之后）插入SEI
+func insertSEI(frame []byte, sei []byte, lengthSize int) []byte {
+	pos := 5
+	if len(frame) > 5+lengthSize && frame[5+lengthSize]&0x1F == naluTypeAUD {
+		size := 0
+		for _, b := range frame[5 : 5+lengthSize] {
+			size = size<<8 | int(b)
+		}
+		if pos += lengthSize + size; pos > len(frame) {
+			pos = 5
+		}
+	}
+	out := make([]byte, 0, len(frame)+len(sei))
+	out = append(out, frame[:pos]...)
+	out = append(out, sei...)
+	return append(out, frame[pos:]...)
+}
+
+// decodeCaptionInfo onCaptionInfo转换为T.35负载：708的data为T.35负载的Base64编码，也兼容只有cc_data的内容；
+// 608的data为CEA-608字节对，放入cc_data作为field 1的数据
+func decodeCaptionInfo(args []any) []byte {
+	obj, _ := firstArg(args).(map[string]any)
+	t, _ := obj["type"].(string)
+	s, _ := obj["data"].(string)
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	switch t {
+	case "608":
+		return cea608ToT35(data)
+	case "708":
+		if !bytes.HasPrefix(data, captionT35Header) {
+			data = append(append([]byte(nil), captionT35Header...), data...)
+		}
+		return data
+	}
+	return nil
+}
+
+// cea608ToT35 CEA-608字节对封装为cc_data，每个cc_data最多31组
+func cea608ToT35(pairs []byte) []byte {
+	count := len(pairs) / 2
+	if count > 31 {
+		count = 31
+	}
+	if count == 0 {
+		return nil
+	}
+	// process_cc_data_flag、cc_count、em_data
+	data := append(append([]byte(nil), captionT35Header...), 0x40|byte(count), 0xFF)
+	for i := 0; i < count; i++ {
+		// marker_bits、cc_valid、cc_type为0（NTSC field 1）
+		data = append(data, 0xFC, pairs[2*i], pairs[2*i+1])
+	}
+	return append(data, 0xFF)
+}
+
+func encodeCaptionInfo(payload []byte) []any {
+	return []any{"onCaptionInfo", map[string]any{
+		"type": "708",
+		"data": base64.StdEncoding.EncodeToString(payload),
+	}}
+}
+
+// sendVideo 按照播放端的字幕格式发送视频帧：sei模式插入等待中的字幕，captioninfo模式把帧中的字幕另外以onCaptionInfo发送
+func (rtmp *RTMPSender) sendVideo(frame *common.AVFrame, ts uint32) error {
+	if rtmp.Video == nil || rtmp.Video.CodecID != codec.CodecID_H264 {
+		return rtmp.send(&rtmp.video, frame, ts)
+	}
+	switch rtmp.captionMode {
+	case CaptionModeSEI:
+		if len(rtmp.captions) == 0 || frame.AVCC.ByteLength < 5 {
+			break
+		}
+		lengthSize := rtmp.naluLengthSize
+		if lengthSize == 0 {
+			lengthSize = 4
+		}
+		data := frame.AVCC.ToBytes()
+		for _, payload := range rtmp.captions {
+			data = insertSEI(data, captionSEI(payload, lengthSize), lengthSize)
+		}
+		rtmp.captions = rtmp.captions[:0]
+		rtmp.aggregate.flush()
+		return rtmp.video.sendRaw(data, ts)
+	case CaptionModeCaptionInfo:
+		if payload := captionPayload(&frame.AVCC, rtmp.naluLengthSize); payload != nil {
+			rtmp.aggregate.flush()
+			if err := rtmp.data.sendRaw(rtmp.encodeData(encodeCaptionInfo(payload)), ts); err != nil {
+				return err
+			}
+		}
+	}
+	return rtmp.send(&rtmp.video, frame, ts)
+}
+
+// API_captions 获取流中检测到的字幕格式、最近的字幕数据和onTextData文本
+func (*RTMPConfig) API_captions(w http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	if info := findCaptionInfo(streamPath); info != nil {
+		util.ReturnValue(info, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNoStream, streamPath+" has no captions", w, r)
+	}
+}
@@ -0,0 +1,55 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestCaptionSEIRoundTrip(t *testing.T) {
+	payload := append(append([]byte(nil), captionT35Header...), 0x41, 0xFF, 0xFC, 0x94, 0x20, 0xFF)
+	for _, lengthSize := range []int{1, 2, 4} {
+		sei := captionSEI(payload, lengthSize)
+		size := 0
+		for _, b := range sei[:lengthSize] {
+			size = size<<8 | int(b)
+		}
+		if size != len(sei)-lengthSize {
+			t.Fatalf("lengthSize %d: length %d, nalu %d", lengthSize, size, len(sei)-lengthSize)
+		}
+		if got := seiCaptionPayload(sei[lengthSize:]); !bytes.Equal(got, payload) {
+			t.Errorf("lengthSize %d: got %x", lengthSize, got)
+		}
+	}
+}
+
+func TestInsertSEIAfterAUD(t *testing.T) {
+	frame := unhex("27 01 000000 0002 09f0 0002 419a")
+	got := insertSEI(frame, unhex("0001 06"), 2)
+	if want := unhex("27 01 000000 0002 09f0 0001 06 0002 419a"); !bytes.Equal(got, want) {
+		t.Fatalf("got %x", got)
+	}
+}
+
+func TestDecodeCaptionInfo(t *testing.T) {
+	info := func(typ string, data []byte) []any {
+		return []any{map[string]any{"type": typ, "data": base64.StdEncoding.EncodeToString(data)}}
+	}
+	header := string(captionT35Header)
+	tests := []struct {
+		name string
+		args []any
+		want []byte
+	}{
+		{"608 pairs", info("608", unhex("9420 942c")), append([]byte(header), unhex("42 ff fc9420 fc942c ff")...)},
+		{"708 cc_data only", info("708", unhex("41 ff fc9420 ff")), append([]byte(header), unhex("41 ff fc9420 ff")...)},
+		{"708 with header", info("708", append([]byte(header), 0x41)), append([]byte(header), 0x41)},
+		{"608 odd byte", info("608", unhex("94")), nil},
+		{"unknown type", info("cea", unhex("9420")), nil},
+	}
+	for _, tt := range tests {
+		if got := decodeCaptionInfo(tt.args); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
@@ -49,7 +49,11 @@ func NewRTMPClient(addr string) (client *NetConnection, err error) {
 		}
 	}()
 	client = NewNetConnection(conn)
-	err = client.ClientHandshake()
+	if u.Scheme == "rtmpe" {
+		err = client.ClientHandshakeRTMPE()
+	} else {
+		err = client.ClientHandshake()
+	}
 	if err != nil {
 		RTMPPlugin.Error("handshake", zap.Error(err))
 		return nil, err
@@ -64,14 +68,14 @@ func NewRTMPClient(addr string) (client *NetConnection, err error) {
 	if len(u.Query()) != 0 {
 		path += "?" + u.RawQuery
 	}
+	object := localCapabilities()
+	object["app"] = client.appName
+	object["flashVer"] = "monibuca/" + engine.Engine.Version
+	object["swfUrl"] = addr
+	object["tcUrl"] = strings.TrimSuffix(addr, path) + "/" + client.appName
 	err = client.SendMessage(RTMP_MSG_AMF0_COMMAND, &CallMessage{
 		CommandMessage{"connect", 1},
-		map[string]any{
-			"app":      client.appName,
-			"flashVer": "monibuca/" + engine.Engine.Version,
-			"swfUrl":   addr,
-			"tcUrl":    strings.TrimSuffix(addr, path) + "/" + client.appName,
-		},
+		object,
 		nil,
 	})
 	if err != nil {
@@ -83,12 +87,13 @@ func NewRTMPClient(addr string) (client *NetConnection, err error) {
 			return nil, err
 		}
 		switch msg.MessageTypeID {
-		case RTMP_MSG_AMF0_COMMAND:
+		case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF3_COMMAND:
 			cmd := msg.MsgData.(Commander).GetCommand()
 			switch cmd.CommandName {
 			case "_result":
 				response := msg.MsgData.(*ResponseMessage)
 				if response.Infomation["code"] == NetConnection_Connect_Success {
+					client.caps = parseCapabilities(response.Properties)
 					return client, nil
 				} else {
 					return nil, err
@@ -118,14 +123,14 @@ func (pusher *RTMPPusher) Disconnect() {
 	}
 }
 func (pusher *RTMPPusher) Push() error {
-	pusher.SendMessage(RTMP_MSG_AMF0_COMMAND, &CommandMessage{"createStream", 2})
+	pusher.createStream()
 	for {
 		msg, err := pusher.RecvMessage()
 		if err != nil {
 			return err
 		}
 		switch msg.MessageTypeID {
-		case RTMP_MSG_AMF0_COMMAND:
+		case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF3_COMMAND:
 			cmd := msg.MsgData.(Commander).GetCommand()
 			switch cmd.CommandName {
 			case Response_Result, Response_OnStatus:
@@ -169,6 +174,15 @@ type RTMPPuller struct {
 }
 
 func (puller *RTMPPuller) Connect() (err error) {
+	// 重连后以远端重新发送的元数据和配置为准
+	puller.metadata.Store(nil)
+	puller.passConfigs.Range(func(key, _ any) bool {
+		puller.passConfigs.Delete(key)
+		return true
+	})
+	puller.captions.Lock()
+	puller.captions.info, puller.captions.naluLengthSize = CaptionInfo{}, 0
+	puller.captions.Unlock()
 	if puller.NetConnection, err = NewRTMPClient(puller.RemoteURL); err == nil {
 		puller.SetIO(puller.NetConnection.Conn)
 		RTMPPlugin.Info("connect", zap.String("remoteURL", puller.RemoteURL))
@@ -183,7 +197,7 @@ func (puller *RTMPPuller) Disconnect() {
 
 func (puller *RTMPPuller) Pull() (err error) {
 	defer puller.Stop()
-	err = puller.SendMessage(RTMP_MSG_AMF0_COMMAND, &CommandMessage{"createStream", 2})
+	err = puller.createStream()
 	for err == nil {
 		msg, err := puller.RecvMessage()
 		if err != nil {
@@ -194,7 +208,9 @@ func (puller *RTMPPuller) Pull() (err error) {
 			puller.ReceiveAudio(msg)
 		case RTMP_MSG_VIDEO:
 			puller.ReceiveVideo(msg)
-		case RTMP_MSG_AMF0_COMMAND:
+		case RTMP_MSG_AMF0_METADATA, RTMP_MSG_AMF3_METADATA:
+			puller.ReceiveData(msg)
+		case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF3_COMMAND:
 			cmd := msg.MsgData.(Commander).GetCommand()
 			switch cmd.CommandName {
 			case "_result":
@@ -0,0 +1,297 @@
+package rtmp
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+// RTMP_CSID_USERDATA 转发的数据消息使用的chunk stream id
+const RTMP_CSID_USERDATA = 0x04
+
+// maxDataQueue 播放端等待发送的数据消息的上限，超过时丢弃最早的
+const maxDataQueue = 256
+
+// dataFrame 推流端通过NetStream.send发送的数据消息，values第一个为处理函数名。
+// tag不为空时是原样转发的音视频标签（见passthrough.go）
+type dataFrame struct {
+	ts        uint32
+	values    []any
+	immediate bool // 在下一帧之前发送，不比较时间戳
+	tag       []byte
+	fourCC    string
+	video     bool
+}
+
+// before 在发送队列中是否应该排在f之前
+func (d *dataFrame) before(f *dataFrame) bool {
+	if d.immediate || f.immediate {
+		return d.immediate
+	}
+	return int32(d.ts-f.ts) <= 0
+}
+
+// dataRelay 同一个流的播放端和转推，收到数据消息时放入它们的发送队列
+type dataRelay struct {
+	sync.Mutex
+	senders map[*RTMPSender]struct{}
+	removed bool // 最后一个播放端离开后已从dataRelays中删除
+}
+
+var dataRelays sync.Map // streamPath -> *dataRelay
+
+func (c *RTMPConfig) relayable(handler string) bool {
+	for _, pattern := range c.DataRelay {
+		if ok, _ := path.Match(pattern, handler); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (rtmp *RTMPSender) joinDataRelay() {
+	for {
+		v, _ := dataRelays.LoadOrStore(rtmp.Stream.Path, &dataRelay{senders: make(map[*RTMPSender]struct{})})
+		relay := v.(*dataRelay)
+		relay.Lock()
+		// 加入之前最后一个播放端离开并删除了它，重新创建
+		if !relay.removed {
+			relay.senders[rtmp] = struct{}{}
+			relay.Unlock()
+			return
+		}
+		relay.Unlock()
+	}
+}
+
+// leaveDataRelay 最后一个播放端离开时删除流的dataRelay
+func (rtmp *RTMPSender) leaveDataRelay() {
+	if rtmp.Stream == nil {
+		return
+	}
+	if v, ok := dataRelays.Load(rtmp.Stream.Path); ok {
+		relay := v.(*dataRelay)
+		relay.Lock()
+		relay.remove(rtmp)
+		if len(relay.senders) == 0 && !relay.removed {
+			relay.removed = true
+			dataRelays.CompareAndDelete(rtmp.Stream.Path, relay)
+		}
+		relay.Unlock()
+	}
+}
+
+// remove 需要持有锁，关闭播放端的原样转发队列，使发送协程退出
+func (relay *dataRelay) remove(rtmp *RTMPSender) {
+	if _, ok := relay.senders[rtmp]; !ok {
+		return
+	}
+	delete(relay.senders, rtmp)
+	if rtmp.passQueue != nil {
+		close(rtmp.passQueue)
+		rtmp.passQueue = nil
+	}
+}
+
+// relayData 把推流端的数据消息转发给播放端，处理函数名需要在允许转发的列表中
+func (r *RTMPReceiver) relayData(ts uint32, handler string, args []any) {
+	if conf.relayable(handler) {
+		relayDataFrame(r.Stream.Path, dataFrame{ts: ts, values: append([]any{handler}, args...)})
+	}
+}
+
+// relayDataFrame 按时间戳顺序放入流的所有播放端和转推的发送队列，原样转发的标签放入单独的队列，返回放入的数量
+func relayDataFrame(streamPath string, f dataFrame) (n int) {
+	v, ok := dataRelays.Load(streamPath)
+	if !ok {
+		return
+	}
+	relay := v.(*dataRelay)
+	relay.Lock()
+	defer relay.Unlock()
+	for rtmp := range relay.senders {
+		if rtmp.IsClosed() {
+			relay.remove(rtmp)
+			continue
+		}
+		if f.tag != nil {
+			rtmp.queuePassthrough(f)
+			n++
+			continue
+		}
+		rtmp.dataLock.Lock()
+		if len(rtmp.dataQueue) >= maxDataQueue {
+			rtmp.dataQueue = rtmp.dataQueue[1:]
+		}
+		i := len(rtmp.dataQueue)
+		for i > 0 && !rtmp.dataQueue[i-1].before(&f) {
+			i--
+		}
+		rtmp.dataQueue = append(rtmp.dataQueue, dataFrame{})
+		copy(rtmp.dataQueue[i+1:], rtmp.dataQueue[i:])
+		rtmp.dataQueue[i] = f
+		rtmp.dataLock.Unlock()
+		n++
+	}
+	return
+}
+
+// sendData 在发送帧之前发送时间戳不大于该帧的数据消息，send为false时（暂停、时移等）丢弃
+func (rtmp *RTMPSender) sendData(frame *common.AVFrame, send bool) {
+	ts := uint32(frame.Timestamp / time.Millisecond)
+	rtmp.dataLock.Lock()
+	i := 0
+	for i < len(rtmp.dataQueue) && rtmp.dataQueue[i].before(&dataFrame{ts: ts}) {
+		i++
+	}
+	frames := rtmp.dataQueue[:i]
+	rtmp.dataQueue = rtmp.dataQueue[i:]
+	rtmp.dataLock.Unlock()
+	if !send || len(frames) == 0 {
+		return
+	}
+	rtmp.aggregate.flush()
+	// 使用该帧的时间戳，保证客户端收到的时间戳不回退
+	dts := ts - rtmp.clock.offset()
+	for _, f := range frames {
+		// sei模式下onCaptionInfo插入之后的视频帧中
+		if rtmp.captionMode == CaptionModeSEI && f.values[0] == "onCaptionInfo" {
+			if payload := decodeCaptionInfo(f.values[1:]); payload != nil && len(rtmp.captions) < maxDataQueue {
+				rtmp.captions = append(rtmp.captions, payload)
+			}
+			continue
+		}
+		if err := rtmp.data.sendRaw(rtmp.encodeData(f.values), dts); err != nil {
+			rtmp.Stop(zap.Error(err))
+			return
+		}
+	}
+}
+
+// encodeData 按照客户端的objectEncoding编码数据消息
+func (rtmp *RTMPSender) encodeData(values []any) []byte {
+	var amf util.AMF
+	if rtmp.objectEncoding == 0 {
+		amf.Marshals(values...)
+		return amf.Buffer
+	}
+	amf3 := avmplusAMF{AMF: amf}
+	amf3.Marshals(values...)
+	return amf3.Buffer
+}
+
+// injectData 把HTTP API提交的数据作为数据消息插入流中，数组展开为多个参数。
+// onCuePoint的参数对象中没有time时使用timestamp（秒）
+func injectData(streamPath, handler string, timestamp *uint32, payload any) (int, error) {
+	if err := validateInjectData(handler, payload); err != nil {
+		return 0, err
+	}
+	f := dataFrame{values: []any{handler}, immediate: timestamp == nil}
+	if timestamp != nil {
+		f.ts = *timestamp
+		if obj, ok := payload.(map[string]any); ok && handler == "onCuePoint" && obj["time"] == nil {
+			obj["time"] = float64(f.ts) / 1000
+		}
+	}
+	if args, ok := payload.([]any); ok {
+		f.values = append(f.values, args...)
+	} else if payload != nil {
+		f.values = append(f.values, payload)
+	}
+	return relayDataFrame(streamPath, f), nil
+}
+
+// validateInjectData 检查onCuePoint和onTextData的参数，其他处理函数不检查。
+// onCuePoint的参数为{name, type: event|navigation, time, parameters}，
+// parameters.type为splice_insert时是SCTE-35的splice_insert，需要splice_event_id，
+// parameters.scte35为Base64编码的splice_info_section时检查table_id和长度
+func validateInjectData(handler string, payload any) error {
+	switch handler {
+	case "onCuePoint":
+		cue, ok := payload.(map[string]any)
+		if !ok {
+			return errors.New("onCuePoint payload must be an object")
+		}
+		if name, _ := cue["name"].(string); name == "" {
+			return errors.New("onCuePoint name required")
+		}
+		if t := cue["type"]; t != "event" && t != "navigation" {
+			return errors.New("onCuePoint type must be event or navigation")
+		}
+		if t, ok := cue["time"]; ok {
+			if v, ok := t.(float64); !ok || v < 0 {
+				return errors.New("onCuePoint time must be a non-negative number")
+			}
+		}
+		params, ok := cue["parameters"]
+		if !ok {
+			return nil
+		}
+		if params, ok := params.(map[string]any); ok {
+			return validateSCTE35(params)
+		}
+		return errors.New("onCuePoint parameters must be an object")
+	case "onTextData":
+		data, ok := payload.(map[string]any)
+		if !ok {
+			return errors.New("onTextData payload must be an object")
+		}
+		if _, ok := data["text"].(string); !ok {
+			return errors.New("onTextData text required")
+		}
+	}
+	return nil
+}
+
+// validateSCTE35 检查onCuePoint参数中的SCTE-35字段
+func validateSCTE35(params map[string]any) error {
+	if params["type"] == "splice_insert" {
+		if !isUint(params["splice_event_id"], 0xFFFFFFFF) {
+			return errors.New("splice_insert splice_event_id must be a 32-bit unsigned integer")
+		}
+		for _, field := range []struct {
+			key string
+			max float64
+		}{{"unique_program_id", 0xFFFF}, {"avail_num", 0xFF}, {"avails_expected", 0xFF}} {
+			if v, ok := params[field.key]; ok && !isUint(v, field.max) {
+				return errors.New("splice_insert " + field.key + " out of range")
+			}
+		}
+		if v, ok := params["duration"]; ok {
+			if d, ok := v.(float64); !ok || d <= 0 {
+				return errors.New("splice_insert duration must be a positive number of seconds")
+			}
+		}
+		for _, key := range []string{"out_of_network", "splice_immediate"} {
+			if v, ok := params[key]; ok {
+				if _, ok := v.(bool); !ok {
+					return errors.New("splice_insert " + key + " must be a boolean")
+				}
+			}
+		}
+	}
+	if v, ok := params["scte35"]; ok {
+		s, _ := v.(string)
+		section, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return errors.New("scte35 must be a base64 encoded splice_info_section")
+		}
+		// table_id为0xFC，section_length为之后的字节数
+		if len(section) < 3 || section[0] != 0xFC || int(section[1]&0x0F)<<8|int(section[2]) != len(section)-3 {
+			return errors.New("scte35 is not a splice_info_section")
+		}
+	}
+	return nil
+}
+
+func isUint(v any, max float64) bool {
+	n, ok := v.(float64)
+	return ok && n >= 0 && n <= max && n == math.Trunc(n)
+}
@@ -0,0 +1,162 @@
+package rtmp
+
+import (
+	"strings"
+	"testing"
+)
+
+// queuedHandlers 返回发送队列中数据消息的处理函数名
+func queuedHandlers(rtmp *RTMPSender) string {
+	rtmp.dataLock.Lock()
+	defer rtmp.dataLock.Unlock()
+	var handlers []string
+	for _, f := range rtmp.dataQueue {
+		handlers = append(handlers, f.values[0].(string))
+	}
+	return strings.Join(handlers, " ")
+}
+
+// 数据消息按时间戳排序，时间戳相同时保持收到的顺序，immediate排在最前；发送时只发送不晚于该帧的
+func TestRelayDataOrder(t *testing.T) {
+	a, c := newTestSender(t, "live/data")
+	for _, f := range []dataFrame{
+		{ts: 300, values: []any{"onA"}},
+		{ts: 100, values: []any{"onB"}},
+		{ts: 200, values: []any{"onC"}},
+		{values: []any{"onD"}, immediate: true},
+		{ts: 200, values: []any{"onE"}},
+	} {
+		if n := relayDataFrame("live/data", f); n != 1 {
+			t.Fatalf("relayed to %d senders", n)
+		}
+	}
+	if got := queuedHandlers(a); got != "onD onB onC onE onA" {
+		t.Fatalf("queue %s", got)
+	}
+	a.sendData(avFrame(200, 0xAF, 1, 0), true)
+	if got := queuedHandlers(a); got != "onA" {
+		t.Errorf("after sending at 200: %s", got)
+	}
+	// 暂停等不发送的帧之前的数据消息被丢弃
+	written := len(c.Bytes())
+	a.sendData(avFrame(400, 0xAF, 1, 0), false)
+	if got := queuedHandlers(a); got != "" || len(c.Bytes()) != written {
+		t.Errorf("after dropping at 400: %q", got)
+	}
+	// 超过上限时丢弃最早的
+	for i := 0; i <= maxDataQueue; i++ {
+		relayDataFrame("live/data", dataFrame{ts: uint32(i), values: []any{"onF"}})
+	}
+	if len(a.dataQueue) != maxDataQueue || a.dataQueue[0].ts != 1 {
+		t.Errorf("queue length %d, first %d", len(a.dataQueue), a.dataQueue[0].ts)
+	}
+}
+
+// 只转发datarelay中允许的处理函数名
+func TestRelayable(t *testing.T) {
+	old := conf.DataRelay
+	conf.DataRelay = []string{"onCuePoint", "on*Data"}
+	t.Cleanup(func() { conf.DataRelay = old })
+	a, _ := newTestSender(t, "live/relayable")
+	r := newPassthroughPublisher("live/relayable")
+	for _, handler := range []string{"onCuePoint", "onTextData", "onCaptionInfo", "onMetaData", "onChat"} {
+		r.relayData(0, handler, nil)
+	}
+	if got := queuedHandlers(a); got != "onCuePoint onTextData onMetaData" {
+		t.Errorf("relayed %s", got)
+	}
+}
+
+// 最后一个播放端离开时删除流的dataRelay，之后加入的播放端使用新的dataRelay
+func TestDataRelayLeave(t *testing.T) {
+	a, _ := newTestSender(t, "live/leave")
+	b, _ := newTestSender(t, "live/leave")
+	v, _ := dataRelays.Load("live/leave")
+	relay := v.(*dataRelay)
+	a.leaveDataRelay()
+	if n := relayDataFrame("live/leave", dataFrame{values: []any{"onA"}}); n != 1 || queuedHandlers(a) != "" {
+		t.Errorf("relayed to %d senders after one left", n)
+	}
+	b.leaveDataRelay()
+	if _, ok := dataRelays.Load("live/leave"); ok || !relay.removed {
+		t.Fatal("relay not removed after the last sender left")
+	}
+	if n := relayDataFrame("live/leave", dataFrame{values: []any{"onB"}}); n != 0 {
+		t.Errorf("relayed to %d senders after all left", n)
+	}
+	c, _ := newTestSender(t, "live/leave")
+	if v, _ := dataRelays.Load("live/leave"); v == relay || relayDataFrame("live/leave", dataFrame{values: []any{"onC"}}) != 1 || queuedHandlers(c) != "onC" {
+		t.Error("new sender did not get a new relay")
+	}
+}
+
+// 插入的数据消息：指定timestamp时按时间戳排序，onCuePoint没有time时使用timestamp；数组展开为多个参数
+func TestInjectData(t *testing.T) {
+	a, _ := newTestSender(t, "live/inject")
+	ts := uint32(120000)
+	cue := map[string]any{"name": "ad", "type": "event", "parameters": map[string]any{
+		"type": "splice_insert", "splice_event_id": 1.0, "duration": 30.0, "out_of_network": true,
+		"scte35": "/DALAAAAAAAAAAAAAAA=",
+	}}
+	if n, err := injectData("live/inject", "onCuePoint", &ts, cue); n != 1 || err != nil {
+		t.Fatalf("onCuePoint: %d, %v", n, err)
+	}
+	if n, err := injectData("live/inject", "onPoll", nil, []any{"q1", 2.0}); n != 1 || err != nil {
+		t.Fatalf("onPoll: %d, %v", n, err)
+	}
+	if got := queuedHandlers(a); got != "onPoll onCuePoint" {
+		t.Fatalf("queue %s", got)
+	}
+	if f := a.dataQueue[0]; len(f.values) != 3 || f.values[1] != "q1" || !f.immediate {
+		t.Errorf("onPoll values %v", f.values)
+	}
+	if f := a.dataQueue[1]; f.ts != ts || f.values[1].(map[string]any)["time"] != 120.0 {
+		t.Errorf("onCuePoint ts %d, values %v", f.ts, f.values)
+	}
+	if n, _ := injectData("live/none", "onTextData", nil, map[string]any{"text": "hi"}); n != 0 {
+		t.Errorf("injected into a stream without senders: %d", n)
+	}
+}
+
+// onCuePoint、SCTE-35的splice_insert和onTextData的参数不合法时返回错误
+func TestValidateInjectData(t *testing.T) {
+	splice := func(params map[string]any) map[string]any {
+		p := map[string]any{"type": "splice_insert", "splice_event_id": 7.0}
+		for k, v := range params {
+			p[k] = v
+		}
+		return map[string]any{"name": "scte35", "type": "event", "parameters": p}
+	}
+	tests := []struct {
+		name    string
+		handler string
+		payload any
+		ok      bool
+	}{
+		{"cue point", "onCuePoint", map[string]any{"name": "chapter", "type": "navigation", "time": 1.5}, true},
+		{"splice_insert", "onCuePoint", splice(map[string]any{"duration": 30.0, "unique_program_id": 1.0, "avail_num": 1.0, "avails_expected": 2.0, "splice_immediate": false}), true},
+		{"other parameters", "onCuePoint", map[string]any{"name": "x", "type": "event", "parameters": map[string]any{"k": "v"}}, true},
+		{"text", "onTextData", map[string]any{"text": "hello", "language": "en"}, true},
+		{"generic", "onPoll", "any", true},
+		{"cue point array", "onCuePoint", []any{"ad"}, false},
+		{"cue point without name", "onCuePoint", map[string]any{"type": "event"}, false},
+		{"cue point type", "onCuePoint", map[string]any{"name": "x", "type": "ad"}, false},
+		{"negative time", "onCuePoint", map[string]any{"name": "x", "type": "event", "time": -1.0}, false},
+		{"parameters not object", "onCuePoint", map[string]any{"name": "x", "type": "event", "parameters": "p"}, false},
+		{"splice_event_id missing", "onCuePoint", splice(map[string]any{"splice_event_id": nil}), false},
+		{"splice_event_id fraction", "onCuePoint", splice(map[string]any{"splice_event_id": 1.5}), false},
+		{"splice_event_id overflow", "onCuePoint", splice(map[string]any{"splice_event_id": float64(1 << 32)}), false},
+		{"avail_num overflow", "onCuePoint", splice(map[string]any{"avail_num": 256.0}), false},
+		{"zero duration", "onCuePoint", splice(map[string]any{"duration": 0.0}), false},
+		{"out_of_network string", "onCuePoint", splice(map[string]any{"out_of_network": "yes"}), false},
+		{"scte35 not base64", "onCuePoint", splice(map[string]any{"scte35": "!"}), false},
+		{"scte35 table_id", "onCuePoint", splice(map[string]any{"scte35": "/TAA"}), false},
+		{"scte35 length", "onCuePoint", splice(map[string]any{"scte35": "/DAFAA=="}), false},
+		{"text missing", "onTextData", map[string]any{"language": "en"}, false},
+	}
+	for _, tt := range tests {
+		if err := validateInjectData(tt.handler, tt.payload); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package rtmp
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+// DVRConfig 时移配置，Duration和Size都为0时不开启
+type DVRConfig struct {
+	Duration time.Duration `desc:"时移窗口时长"`
+	Size     int           `desc:"时移窗口最大字节数，0表示不限制"`
+	Filter   string        `desc:"需要时移的streamPath正则，为空则所有流"`
+}
+
+func (c *DVRConfig) match(streamPath string) bool {
+	if c.Duration == 0 && c.Size == 0 {
+		return false
+	}
+	if c.Filter == "" {
+		return true
+	}
+	ok, _ := regexp.MatchString(c.Filter, streamPath)
+	return ok
+}
+
+var (
+	ErrSeekInvalidTime = errors.New("seek time out of dvr window")
+	ErrSeekFailed      = errors.New("stream has no dvr window")
+	dvrs               sync.Map // streamPath -> *DVR
+)
+
+type dvrFrame struct {
+	video  bool
+	iframe bool
+	ts     uint32 // 流的时间戳，毫秒
+	data   []byte
+}
+
+// DVR 单个流的时移环形缓冲，总是从关键帧开始
+type DVR struct {
+	sync.RWMutex
+	DVRConfig
+	frames             []dvrFrame
+	size               int
+	audioSeq, videoSeq []byte
+}
+
+func findDVR(streamPath string) *DVR {
+	if v, ok := dvrs.Load(streamPath); ok {
+		return v.(*DVR)
+	}
+	return nil
+}
+
+func (dvr *DVR) write(f dvrFrame) {
+	dvr.Lock()
+	defer dvr.Unlock()
+	dvr.frames = append(dvr.frames, f)
+	dvr.size += len(f.data)
+	// 有视频时至少保留最近的关键帧之后的帧，窗口小于一个GOP时也从关键帧开始
+	limit := len(dvr.frames) - 1
+	for ; limit > 0 && dvr.videoSeq != nil && !(dvr.frames[limit].video && dvr.frames[limit].iframe); limit-- {
+	}
+	if !(dvr.frames[limit].video && dvr.frames[limit].iframe) {
+		// 还没有关键帧
+		limit = len(dvr.frames) - 1
+	}
+	var i int
+	for ; i < limit; i++ {
+		// 时间戳回退时差值为负，按0处理
+		span := int32(f.ts - dvr.frames[i].ts)
+		tooLong := dvr.Duration > 0 && span > 0 && time.Duration(span)*time.Millisecond > dvr.Duration
+		tooBig := dvr.Size > 0 && dvr.size > dvr.Size
+		if !tooLong && !tooBig {
+			break
+		}
+		dvr.size -= len(dvr.frames[i].data)
+	}
+	// 有视频时窗口从关键帧开始
+	for ; i < limit && dvr.videoSeq != nil; i++ {
+		if dvr.frames[i].video && dvr.frames[i].iframe {
+			break
+		}
+		dvr.size -= len(dvr.frames[i].data)
+	}
+	dvr.frames = dvr.frames[i:]
+}
+
+// Range 时移窗口的起止时间戳
+func (dvr *DVR) Range() (first, last uint32, ok bool) {
+	dvr.RLock()
+	defer dvr.RUnlock()
+	if len(dvr.frames) == 0 {
+		return 0, 0, false
+	}
+	return dvr.frames[0].ts, dvr.frames[len(dvr.frames)-1].ts, true
+}
+
+// next 返回时间戳大于ts的第一帧，from为true时返回不晚于ts的最近的关键帧
+func (dvr *DVR) next(ts uint32, from bool) (f dvrFrame, ok bool) {
+	dvr.RLock()
+	defer dvr.RUnlock()
+	i := sort.Search(len(dvr.frames), func(i int) bool {
+		return dvr.frames[i].ts > ts
+	})
+	if from {
+		for i--; i > 0 && dvr.videoSeq != nil && !(dvr.frames[i].video && dvr.frames[i].iframe); i-- {
+		}
+		if i < 0 {
+			i = 0
+		}
+	}
+	if i < len(dvr.frames) {
+		return dvr.frames[i], true
+	}
+	return
+}
+
+// dvrRecorder 订阅流并写入时移缓冲
+type dvrRecorder struct {
+	Subscriber
+	dvr *DVR
+}
+
+func (r *dvrRecorder) OnEvent(event any) {
+	switch v := event.(type) {
+	case AudioDeConf:
+		r.dvr.Lock()
+		r.dvr.audioSeq = append([]byte(nil), v...)
+		r.dvr.Unlock()
+	case VideoDeConf:
+		r.dvr.Lock()
+		r.dvr.videoSeq = append([]byte(nil), v...)
+		r.dvr.Unlock()
+	case AudioFrame:
+		r.dvr.write(dvrFrame{false, false, uint32(v.Timestamp / time.Millisecond), v.AVCC.ToBytes()})
+	case VideoFrame:
+		r.dvr.write(dvrFrame{true, v.IFrame, uint32(v.Timestamp / time.Millisecond), v.AVCC.ToBytes()})
+	default:
+		r.Subscriber.OnEvent(event)
+	}
+}
+
+func startDVR(streamPath string, c DVRConfig) {
+	r := &dvrRecorder{dvr: &DVR{DVRConfig: c}}
+	r.ID = "dvr"
+	if err := RTMPPlugin.Subscribe(streamPath, r); err != nil {
+		RTMPPlugin.Error("dvr", zap.String("streamPath", streamPath), zap.Error(err))
+		return
+	}
+	dvrs.Store(streamPath, r.dvr)
+	// 重新推流后新的时移缓冲可能已经替换了这个
+	defer dvrs.CompareAndDelete(streamPath, r.dvr)
+	r.PlayRaw()
+}
+
+// sendRaw 以绝对时间戳发送时移缓冲中的一帧
+func (av *AVSender) sendRaw(data []byte, ts uint32) error {
+	return av.sendTag(av.exTag(data), ts)
+}
+
+// sendTag 以完整的消息头发送已经是发送格式的标签
+func (av *AVSender) sendTag(data []byte, ts uint32) error {
+	// 时移协程和发送直播帧的协程共用消息头，获得写锁之后才能修改
+	for !av.writing.CompareAndSwap(false, true) {
+		runtime.Gosched()
+	}
+	defer av.writing.Store(false)
+	av.MessageLength = uint32(len(data))
+	av.SetTimestamp(ts)
+	// 之后的直播帧需要使用绝对时间戳
+	av.firstSent.Store(false)
+	av.WriteTo(RTMP_CHUNK_HEAD_12, &av.chunkHeader)
+	var head1 util.Buffer
+	av.WriteTo(RTMP_CHUNK_HEAD_1, &head1)
+	chunk := net.Buffers{av.chunkHeader}
+	for i, b := range util.Buffer(data).Split(av.writeChunkSize) {
+		if i > 0 {
+			chunk = append(chunk, head1)
+		}
+		chunk = append(chunk, b)
+	}
+	n, err := chunk.WriteTo(av.Conn)
+	av.writeSeqNum += uint32(n)
+	return err
+}
+
+// Seek 跳转到客户端时间轴上的ms位置，超出时移窗口末尾时回到直播
+func (rtmp *RTMPSender) Seek(ms uint32) error {
+	dvr := findDVR(rtmp.Stream.Path)
+	if dvr == nil {
+		return ErrSeekFailed
+	}
+	first, last, ok := dvr.Range()
+	if !ok {
+		return ErrSeekFailed
+	}
+	ts := ms + rtmp.clock.offset()
+	if ts < first {
+		return ErrSeekInvalidTime
+	}
+	if ts >= last {
+		rtmp.GoLive()
+		return nil
+	}
+	rtmp.timeshift(dvr, ts, false)
+	return nil
+}
+
+// seek 处理seek命令并响应结果
+func (rtmp *RTMPSender) seek(tid uint64, ms uint32) error {
+	switch err := rtmp.Seek(ms); err {
+	case nil:
+		rtmp.Response(tid, NetStream_Seek_Notify, Level_Status)
+		return rtmp.Response(tid, NetStream_Play_Start, Level_Status)
+	case ErrSeekInvalidTime:
+		return rtmp.SendStatus(tid, NetStream_Seek_InvalidTime, Level_Error, err.Error())
+	default:
+		return rtmp.SendStatus(tid, NetStream_Seek_Failed, Level_Error, err.Error())
+	}
+}
+
+// GoLive 结束时移，从最新的关键帧恢复直播
+func (rtmp *RTMPSender) GoLive() {
+	rtmp.dvrGen.Add(1)
+	rtmp.resuming.Store(true)
+	rtmp.timeshifting.Store(false)
+}
+
+// timeshift 从ts之前最近的关键帧开始发送时移缓冲，continuous为true时调整时间戳使其与已发送的帧连续
+func (rtmp *RTMPSender) timeshift(dvr *DVR, ts uint32, continuous bool) {
+	gen := rtmp.dvrGen.Add(1)
+	rtmp.clock.Lock()
+	rtmp.clock.started = true
+	rtmp.clock.Unlock()
+	rtmp.timeshifting.Store(true)
+	go rtmp.playDVR(dvr, ts, gen, continuous)
+}
+
+// playDVR 按照时间戳的节奏发送时移缓冲中的帧，直到Seek、GoLive、暂停或者订阅结束
+func (rtmp *RTMPSender) playDVR(dvr *DVR, ts uint32, gen uint32, continuous bool) {
+	dvr.RLock()
+	audioSeq, videoSeq := dvr.audioSeq, dvr.videoSeq
+	dvr.RUnlock()
+	rtmp.sendSequenceHeads(audioSeq, videoSeq)
+	f, ok := dvr.next(ts, true)
+	if !ok {
+		rtmp.GoLive()
+		return
+	}
+	clock := &rtmp.clock
+	clock.Lock()
+	if continuous {
+		clock.timeOffset += f.ts - clock.lastTS
+	}
+	clock.counting = false
+	clock.Unlock()
+	start, startTS, lastTS := time.Now(), f.ts, f.ts
+	for rtmp.dvrGen.Load() == gen && !rtmp.paused.Load() && !rtmp.IsClosed() {
+		if ok {
+			if wait := time.Duration(f.ts-startTS)*time.Millisecond - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+			av := &rtmp.audio
+			if f.video {
+				av = &rtmp.video
+			}
+			if av.receiving(f.iframe) {
+				if err := av.sendRaw(f.data, f.ts-clock.offset()); err != nil {
+					rtmp.Stop(zap.Error(err))
+					return
+				}
+			}
+			lastTS = f.ts
+			clock.Lock()
+			clock.advance(lastTS)
+			clock.Unlock()
+			rtmp.checkDuration()
+		} else {
+			time.Sleep(time.Millisecond * 10)
+		}
+		f, ok = dvr.next(lastTS, false)
+	}
+}
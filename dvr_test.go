@@ -0,0 +1,164 @@
+package rtmp
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	engine "m7s.live/engine/v4"
+)
+
+// newTestDVR 每100ms一帧视频，每1000ms一个关键帧，时间戳从0到end
+func newTestDVR(c DVRConfig, end uint32) *DVR {
+	dvr := &DVR{DVRConfig: c, videoSeq: []byte{0x17, 0}}
+	for ts := uint32(0); ts <= end; ts += 100 {
+		dvr.write(dvrFrame{true, ts%1000 == 0, ts, make([]byte, 10)})
+	}
+	return dvr
+}
+
+func TestDVRWindow(t *testing.T) {
+	tests := []struct {
+		name        string
+		c           DVRConfig
+		end         uint32
+		first, last uint32
+	}{
+		{"not full", DVRConfig{Duration: 5 * time.Second}, 3000, 0, 3000},
+		// 超过1500ms的帧被丢弃后从下一个关键帧开始
+		{"duration wraps to keyframe", DVRConfig{Duration: 1500 * time.Millisecond}, 3000, 2000, 3000},
+		{"size wraps to keyframe", DVRConfig{Size: 150}, 10000, 9000, 10000},
+		{"window smaller than a gop keeps latest keyframe", DVRConfig{Size: 10}, 2500, 2000, 2500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dvr := newTestDVR(tt.c, tt.end)
+			first, last, ok := dvr.Range()
+			if !ok || first != tt.first || last != tt.last {
+				t.Fatalf("range %d-%d", first, last)
+			}
+			if !dvr.frames[0].iframe {
+				t.Error("window does not start with a keyframe")
+			}
+			size := 0
+			for _, f := range dvr.frames {
+				size += len(f.data)
+			}
+			if size != dvr.size {
+				t.Errorf("size %d, counted %d", dvr.size, size)
+			}
+		})
+	}
+	if _, _, ok := (&DVR{}).Range(); ok {
+		t.Error("empty dvr has a range")
+	}
+}
+
+// 只有音频时按帧裁剪，不等待关键帧
+func TestDVRAudioOnly(t *testing.T) {
+	dvr := &DVR{DVRConfig: DVRConfig{Size: 30}}
+	for ts := uint32(0); ts < 1000; ts += 10 {
+		dvr.write(dvrFrame{false, false, ts, make([]byte, 10)})
+	}
+	if first, last, _ := dvr.Range(); first != 970 || last != 990 {
+		t.Fatalf("range %d-%d", first, last)
+	}
+}
+
+func TestDVRNext(t *testing.T) {
+	dvr := newTestDVR(DVRConfig{Duration: 10 * time.Second}, 3000)
+	dvr.frames = dvr.frames[3:] // 窗口开头不是关键帧的情况
+	tests := []struct {
+		name string
+		ts   uint32
+		from bool
+		want uint32
+		ok   bool
+	}{
+		{"before window start", 100, true, 300, true},
+		{"exactly on keyframe", 2000, true, 2000, true},
+		{"between keyframes", 2500, true, 2000, true},
+		{"after live", 5000, true, 3000, true},
+		{"next frame", 2000, false, 2100, true},
+		{"next before window", 0, false, 300, true},
+		{"no frame after live", 3000, false, 0, false},
+	}
+	for _, tt := range tests {
+		f, ok := dvr.next(tt.ts, tt.from)
+		if ok != tt.ok || ok && f.ts != tt.want {
+			t.Errorf("%s: got %d %v, want %d %v", tt.name, f.ts, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDVRSeek(t *testing.T) {
+	const streamPath = "live/dvrtest"
+	dvr := newTestDVR(DVRConfig{Duration: 10 * time.Second}, 3000)
+	dvr.frames = dvr.frames[10:]
+	rtmp := &RTMPSender{}
+	rtmp.Stream = &engine.Stream{Path: streamPath}
+	if err := rtmp.Seek(0); err != ErrSeekFailed {
+		t.Fatalf("without dvr: %v", err)
+	}
+	dvrs.Store(streamPath, dvr)
+	t.Cleanup(func() {
+		dvrs.Delete(streamPath)
+	})
+	if err := rtmp.Seek(500); err != ErrSeekInvalidTime {
+		t.Fatalf("before window: %v", err)
+	}
+	rtmp.timeshifting.Store(true)
+	gen := rtmp.dvrGen.Load()
+	if err := rtmp.Seek(3000); err != nil {
+		t.Fatalf("after live: %v", err)
+	}
+	if rtmp.timeshifting.Load() || !rtmp.resuming.Load() || rtmp.dvrGen.Load() != gen+1 {
+		t.Error("seek after live did not go live")
+	}
+	// 客户端时间轴加上偏移量才是流的时间戳，没有偏移量时1000在窗口内
+	rtmp.clock.timeOffset = 2000
+	if err := rtmp.Seek(1000); err != nil || rtmp.dvrGen.Load() != gen+2 {
+		t.Fatalf("with offset: %v", err)
+	}
+}
+
+// 写入的同时读取，读到的帧的时间戳总是递增
+func TestDVRConcurrent(t *testing.T) {
+	dvr := &DVR{DVRConfig: DVRConfig{Size: 1000}, videoSeq: []byte{0x17, 0}}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for ts := uint32(0); ts < 20000; ts += 10 {
+			dvr.write(dvrFrame{true, ts%500 == 0, ts, make([]byte, 10)})
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last uint32
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if first, end, ok := dvr.Range(); ok && first > end {
+					t.Errorf("range %d-%d", first, end)
+					return
+				}
+				if f, ok := dvr.next(last, false); ok {
+					if f.ts <= last && last != 0 {
+						t.Errorf("next(%d) returned %d", last, f.ts)
+						return
+					}
+					last = f.ts
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
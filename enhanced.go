@@ -0,0 +1,519 @@
+package rtmp
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// Enhanced RTMP https://github.com/veovera/enhanced-rtmp
+const (
+	PacketTypeSequenceStart        = 0
+	PacketTypeCodedFrames          = 1
+	PacketTypeSequenceEnd          = 2
+	PacketTypeCodedFramesX         = 3
+	PacketTypeMetadata             = 4
+	PacketTypeMPEG2TSSequenceStart = 5
+	PacketTypeMultitrack           = 6
+
+	FourCC_AVC  = "avc1"
+	FourCC_HEVC = "hvc1"
+	FourCC_AV1  = "av01"
+	FourCC_VP9  = "vp09"
+	FourCC_AAC  = "mp4a"
+	FourCC_MP3  = ".mp3"
+	FourCC_Opus = "Opus"
+	FourCC_FLAC = "fLaC"
+	FourCC_AC3  = "ac-3"
+	FourCC_EAC3 = "ec-3"
+
+	SoundFormatExHeader               = 9 // SoundFormat为9时使用ExAudioTagHeader
+	AudioPacketTypeSequenceStart      = 0
+	AudioPacketTypeCodedFrames        = 1
+	AudioPacketTypeSequenceEnd        = 2
+	AudioPacketTypeMultichannelConfig = 4
+	AudioPacketTypeMultitrack         = 5
+
+	AudioChannelOrderUnspecified = 0
+	AudioChannelOrderNative      = 1 // 使用AudioChannelFlags
+	AudioChannelOrderCustom      = 2 // 使用AudioChannelMapping
+
+	AvMultitrackTypeOneTrack             = 0
+	AvMultitrackTypeManyTracks           = 1
+	AvMultitrackTypeManyTracksManyCodecs = 2
+
+	VideoFrameTypeCommand = 5 // 视频信息/命令帧，不含视频数据
+)
+
+// isExHeader ExVideoTagHeader第一个字节的最高位为IsExHeader
+func isExHeader(b0 byte) bool {
+	return b0&0b1000_0000 != 0
+}
+
+// exVideoToLegacy 把E-RTMP的视频标签转换为引擎能识别的旧格式视频标签，Multitrack包拆分后写入各个轨道。
+// 不需要写入主轨道的包返回false
+func (r *RTMPReceiver) exVideoToLegacy(msg *Chunk) bool {
+	data := msg.AVData.ToBytes()
+	if len(data) < 5 {
+		return false
+	}
+	frameType := data[0] >> 4 & 0b0111
+	packetType := data[0] & 0b1111
+	if packetType == PacketTypeMultitrack {
+		r.receiveMultitrack(msg.ExtendTimestamp, data, true)
+		return false
+	}
+	fourCC := string(data[1:5])
+	if isPassthrough(fourCC) || packetType == PacketTypeMPEG2TSSequenceStart {
+		r.passthrough(msg.ExtendTimestamp, fourCC, packetType, data, true)
+		return false
+	}
+	head, payload, ok := r.legacyVideoTag(frameType, packetType, fourCC, data[5:])
+	if !ok {
+		return false
+	}
+	msg.AVData.Recycle()
+	msg.AVData = r.newTag(head, payload)
+	return true
+}
+
+// legacyVideoTag 转换为旧格式的视频标签，不需要写入的包返回false
+func (r *RTMPReceiver) legacyVideoTag(frameType, packetType byte, fourCC string, payload []byte) (head []byte, _ []byte, ok bool) {
+	if head, payload, ok = toLegacyVideoTag(frameType, packetType, fourCC, payload); ok {
+		return head, payload, true
+	}
+	switch {
+	case videoCodecID(fourCC) == 0:
+		r.Warn("unsupported video fourcc", zap.String("fourcc", fourCC))
+	case packetType == PacketTypeSequenceEnd:
+		r.Info("video sequence end", zap.String("fourcc", fourCC))
+	}
+	return
+}
+
+// videoCodecID 引擎中有对应轨道的视频FourCC，没有时返回0
+func videoCodecID(fourCC string) codec.VideoCodecID {
+	switch fourCC {
+	case FourCC_AVC:
+		return codec.CodecID_H264
+	case FourCC_HEVC:
+		return codec.CodecID_H265
+	case FourCC_AV1:
+		return codec.CodecID_AV1
+	}
+	return 0
+}
+
+// toLegacyVideoTag 转换为旧格式的视频标签头：FrameType(4) CodecID(4) AVCPacketType(8) CompositionTime(24)，
+// H265和AV1使用扩展的CodecID 12和13。命令帧、SequenceEnd和MPEG2TSSequenceStart不转换
+func toLegacyVideoTag(frameType, packetType byte, fourCC string, payload []byte) (head []byte, _ []byte, ok bool) {
+	codecID := videoCodecID(fourCC)
+	if codecID == 0 || frameType == VideoFrameTypeCommand {
+		return
+	}
+	cts := []byte{0, 0, 0}
+	var avcPacketType byte
+	switch packetType {
+	case PacketTypeSequenceStart:
+		avcPacketType = 0
+	case PacketTypeCodedFrames:
+		avcPacketType = 1
+		// 只有AVC和HEVC带有CompositionTime
+		if codecID == codec.CodecID_H264 || codecID == codec.CodecID_H265 {
+			if len(payload) < 3 {
+				return
+			}
+			cts, payload = payload[:3], payload[3:]
+		}
+	case PacketTypeCodedFramesX:
+		avcPacketType = 1
+	default:
+		return
+	}
+	head = append([]byte{frameType<<4 | byte(codecID), avcPacketType}, cts...)
+	return head, payload, true
+}
+
+// exAudioToLegacy 把ExAudioTagHeader的音频标签转换为旧格式，Multitrack包拆分后写入各个轨道。
+// 不需要写入主轨道的包返回false
+func (r *RTMPReceiver) exAudioToLegacy(msg *Chunk) bool {
+	data := msg.AVData.ToBytes()
+	if len(data) < 2 {
+		return false
+	}
+	packetType := data[0] & 0b1111
+	if packetType == AudioPacketTypeMultitrack {
+		r.receiveMultitrack(msg.ExtendTimestamp, data, false)
+		return false
+	}
+	if len(data) < 5 {
+		return false
+	}
+	fourCC := string(data[1:5])
+	if isPassthrough(fourCC) {
+		r.passthrough(msg.ExtendTimestamp, fourCC, packetType, data, false)
+		return false
+	}
+	if packetType == AudioPacketTypeMultichannelConfig {
+		// 以Enhanced RTMP格式播放时随序列头一起发送
+		r.passConfigs.Store(auxConfigKey(fourCC), append([]byte(nil), data...))
+	}
+	head, payload, ok := r.legacyAudioTag(packetType, fourCC, data[5:])
+	if !ok {
+		return false
+	}
+	msg.AVData.Recycle()
+	msg.AVData = r.newTag(head, payload)
+	return true
+}
+
+// legacyAudioTag 转换为旧格式的音频标签头：SoundFormat(4) SoundRate(2) SoundSize(1) SoundType(1) [AACPacketType(8)]，
+// Opus使用扩展的SoundFormat 12，同样带有PacketType
+func (r *RTMPReceiver) legacyAudioTag(packetType byte, fourCC string, payload []byte) (head []byte, _ []byte, ok bool) {
+	switch packetType {
+	case AudioPacketTypeSequenceStart, AudioPacketTypeCodedFrames:
+	case AudioPacketTypeSequenceEnd:
+		r.Info("audio sequence end", zap.String("fourcc", fourCC))
+		return
+	case AudioPacketTypeMultichannelConfig:
+		r.multichannelConfig(fourCC, payload)
+		return
+	default:
+		r.Debug("ignore audio packet", zap.String("fourcc", fourCC), zap.Uint8("packetType", packetType))
+		return
+	}
+	switch fourCC {
+	case FourCC_AAC:
+		head = []byte{byte(codec.CodecID_AAC)<<4 | 0x0F, packetType}
+	case FourCC_Opus:
+		// SequenceStart为可选的OpusHead
+		head = []byte{byte(codec.CodecID_OPUS)<<4 | 0x0F, packetType}
+	case FourCC_MP3:
+		if packetType == AudioPacketTypeSequenceStart {
+			return
+		}
+		head = []byte{2<<4 | 0x0F}
+	default:
+		r.Warn("unsupported audio fourcc", zap.String("fourcc", fourCC))
+		return
+	}
+	return head, payload, true
+}
+
+// multichannelConfig 解析MultichannelConfig，声道数记录到音频轨道和流的元数据中
+func (r *RTMPReceiver) multichannelConfig(fourCC string, payload []byte) {
+	if len(payload) < 2 || r.Stream == nil {
+		return
+	}
+	order, count := payload[0], payload[1]
+	fields := []zap.Field{zap.String("fourcc", fourCC), zap.Uint8("channelOrder", order), zap.Uint8("channelCount", count)}
+	switch order {
+	case AudioChannelOrderNative:
+		if len(payload) >= 6 {
+			var flags uint32
+			util.GetBE(payload[2:6], &flags)
+			fields = append(fields, zap.Uint32("channelFlags", flags))
+		}
+	case AudioChannelOrderCustom:
+		if len(payload) >= 2+int(count) {
+			fields = append(fields, zap.Binary("channelMapping", payload[2:2+int(count)]))
+		}
+	}
+	r.Info("audio multichannel config", fields...)
+	// Opus轨道可能还没有创建，创建时再设置
+	r.audioChannels = count
+	if opus, ok := r.AudioTrack.(*track.Opus); ok {
+		opus.Channels = count
+	}
+	var m MetaData
+	if old := r.metadata.Load(); old != nil {
+		m = *old
+	}
+	m.AudioChannels = float64(count)
+	m.Stereo = count > 1
+	r.metadata.Store(&m)
+}
+
+// writeAudio 写入主音频轨道，引擎不会根据旧格式标签创建Opus轨道，需要自己创建
+func (r *RTMPReceiver) writeAudio(ts uint32, tag *util.BLL) {
+	if r.AudioTrack == nil {
+		if codec.AudioCodecID(tag.GetByte(0)>>4) != codec.CodecID_OPUS {
+			r.WriteAVCCAudio(0, tag, r.bytePool)
+			return
+		}
+		opus := track.NewOpus(r, r.bytePool)
+		if r.audioChannels > 0 {
+			opus.Channels = r.audioChannels
+		}
+		r.AudioTrack = opus
+	}
+	r.AudioTrack.WriteAVCC(ts, tag)
+}
+
+// newTag 用内存池中的内存组成标签
+func (r *RTMPReceiver) newTag(head, payload []byte) (tag util.BLL) {
+	mem := r.bytePool.Get(len(head) + len(payload))
+	copy(mem.Value, head)
+	copy(mem.Value[len(head):], payload)
+	tag.Push(mem)
+	return
+}
+
+// FourCcInfoMask E-RTMP v2中videoFourCcInfoMap、audioFourCcInfoMap的值
+const (
+	FourCcInfoCanDecode  = 0x01
+	FourCcInfoCanEncode  = 0x02
+	FourCcInfoCanForward = 0x04
+)
+
+// CapsEx E-RTMP v2中capsEx的值
+const (
+	CapsExReconnect           = 0x01
+	CapsExMultitrack          = 0x02
+	CapsExModEx               = 0x04
+	CapsExTimestampNanoOffset = 0x08
+)
+
+// 本服务支持接收和转发的编码
+var (
+	VideoFourCCs = []string{FourCC_AVC, FourCC_HEVC, FourCC_AV1, FourCC_VP9}
+	AudioFourCCs = []string{FourCC_AAC, FourCC_Opus, FourCC_FLAC, FourCC_AC3, FourCC_EAC3}
+	CapsEx       = CapsExMultitrack
+)
+
+// Capabilities connect中协商的E-RTMP能力
+type Capabilities struct {
+	FourCcList         []string       // nil表示对端没有声明，使用旧格式
+	VideoFourCcInfoMap map[string]int // FourCC -> FourCcInfoMask，"*"表示所有
+	AudioFourCcInfoMap map[string]int
+	CapsEx             int
+}
+
+// parseCapabilities 解析connect命令或其_result中的E-RTMP字段
+func parseCapabilities(object map[string]any) (caps Capabilities) {
+	if arr, ok := object["fourCcList"].([]any); ok {
+		caps.FourCcList = make([]string, 0, len(arr))
+		for _, v := range arr {
+			if s, ok := v.(string); ok {
+				caps.FourCcList = append(caps.FourCcList, s)
+			}
+		}
+	}
+	caps.VideoFourCcInfoMap = parseInfoMap(object["videoFourCcInfoMap"])
+	caps.AudioFourCcInfoMap = parseInfoMap(object["audioFourCcInfoMap"])
+	if v, ok := object["capsEx"].(float64); ok {
+		caps.CapsEx = int(v)
+	}
+	return
+}
+
+func parseInfoMap(v any) map[string]int {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+	m := make(map[string]int, len(obj))
+	for k, v := range obj {
+		mask, _ := v.(float64)
+		m[k] = int(mask)
+	}
+	return m
+}
+
+// localCapabilities 本服务的能力，作为服务端时在connect的_result中、作为客户端时在connect中发送
+func localCapabilities() map[string]any {
+	fourCcList := make([]any, 0, len(VideoFourCCs)+len(AudioFourCCs))
+	videoMap := make(map[string]any, len(VideoFourCCs))
+	audioMap := make(map[string]any, len(AudioFourCCs))
+	for _, f := range VideoFourCCs {
+		fourCcList = append(fourCcList, f)
+		videoMap[f] = fourCcInfo(f)
+	}
+	for _, f := range AudioFourCCs {
+		fourCcList = append(fourCcList, f)
+		audioMap[f] = fourCcInfo(f)
+	}
+	return map[string]any{
+		"fourCcList":         fourCcList,
+		"videoFourCcInfoMap": videoMap,
+		"audioFourCcInfoMap": audioMap,
+		"capsEx":             CapsEx,
+	}
+}
+
+// fourCcInfo 原样转发的编码只能转发
+func fourCcInfo(fourCC string) int {
+	if isPassthrough(fourCC) {
+		return FourCcInfoCanForward
+	}
+	return FourCcInfoCanDecode | FourCcInfoCanForward
+}
+
+// Declared 对端是否声明了E-RTMP能力
+func (caps *Capabilities) Declared() bool {
+	return caps.FourCcList != nil || caps.VideoFourCcInfoMap != nil || caps.AudioFourCcInfoMap != nil
+}
+
+// Support 对端能否接收fourCC编码的媒体，优先使用InfoMap，其次使用fourCcList
+func (caps *Capabilities) Support(fourCC string, video bool) bool {
+	infoMap := caps.AudioFourCcInfoMap
+	if video {
+		infoMap = caps.VideoFourCcInfoMap
+	}
+	if infoMap != nil {
+		mask, ok := infoMap[fourCC]
+		if !ok {
+			mask = infoMap["*"]
+		}
+		return mask&(FourCcInfoCanDecode|FourCcInfoCanForward) != 0
+	}
+	for _, f := range caps.FourCcList {
+		if f == fourCC || f == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseVideoFormat 根据对端声明的fourCcList选择视频的发送格式，H265和AV1使用Enhanced RTMP。
+// 对端没有声明fourCcList时保持旧格式，声明了但不支持该编码时返回错误
+func (rtmp *RTMPSender) chooseVideoFormat() error {
+	if rtmp.Video == nil {
+		return nil
+	}
+	var fourCC string
+	switch rtmp.Video.CodecID {
+	case codec.CodecID_H265:
+		fourCC = FourCC_HEVC
+	case codec.CodecID_AV1:
+		fourCC = FourCC_AV1
+	default:
+		rtmp.video.fourCC = ""
+		return nil
+	}
+	if !rtmp.caps.Declared() {
+		return nil
+	}
+	if !rtmp.caps.Support(fourCC, true) {
+		return fmt.Errorf("client does not support %s", fourCC)
+	}
+	rtmp.video.fourCC = fourCC
+	return nil
+}
+
+// playFailed 播放端不支持流的编码时响应NetStream.Play.Failed并停止订阅
+func (rtmp *RTMPSender) playFailed(err error) {
+	rtmp.SendStatus(0, NetStream_Play_Failed, Level_Error, err.Error())
+	rtmp.Stop(zap.Error(err))
+}
+
+// chooseAudioFormat 根据对端声明的能力选择音频的发送格式，Opus使用Enhanced RTMP，其他编码使用旧格式
+func (rtmp *RTMPSender) chooseAudioFormat() error {
+	rtmp.audio.formatChosen = true
+	if rtmp.Audio == nil || rtmp.Audio.CodecID != codec.CodecID_OPUS {
+		rtmp.audio.fourCC = ""
+		return nil
+	}
+	if !rtmp.caps.Declared() {
+		return nil
+	}
+	if !rtmp.caps.Support(FourCC_Opus, false) {
+		return fmt.Errorf("client does not support %s", FourCC_Opus)
+	}
+	rtmp.audio.fourCC = FourCC_Opus
+	return nil
+}
+
+// exVideoHeader 把旧格式视频标签的前5个字节转换为ExVideoTagHeader
+func exVideoHeader(fourCC string, legacy []byte) []byte {
+	frameType := legacy[0] >> 4
+	var packetType byte
+	switch legacy[1] {
+	case 0:
+		packetType = PacketTypeSequenceStart
+	case 2:
+		packetType = PacketTypeSequenceEnd
+	default:
+		packetType = PacketTypeCodedFramesX
+		// 只有AVC和HEVC可以携带CompositionTime，为0时使用CodedFramesX
+		if (fourCC == FourCC_AVC || fourCC == FourCC_HEVC) && (legacy[2]|legacy[3]|legacy[4]) != 0 {
+			packetType = PacketTypeCodedFrames
+		}
+	}
+	head := append([]byte{0b1000_0000 | frameType<<4 | packetType}, fourCC...)
+	if packetType == PacketTypeCodedFrames {
+		head = append(head, legacy[2:5]...)
+	}
+	return head
+}
+
+// exAudioHeader 把旧格式音频标签头转换为ExAudioTagHeader，返回被替换的旧标签头长度
+func exAudioHeader(fourCC string, legacy []byte) ([]byte, int) {
+	packetType, n := byte(AudioPacketTypeCodedFrames), 1
+	if fourCC == FourCC_AAC || fourCC == FourCC_Opus {
+		// AAC和Opus的第二个字节为PacketType
+		if n = 2; legacy[1] == 0 {
+			packetType = AudioPacketTypeSequenceStart
+		}
+	}
+	return append([]byte{SoundFormatExHeader<<4 | packetType}, fourCC...), n
+}
+
+// multitrackHeader 把单轨道的Enhanced RTMP标签头转换为OneTrack的Multitrack标签头
+func multitrackHeader(head []byte, multitrackType, trackID byte) []byte {
+	mt := []byte{head[0]&0xF0 | multitrackType, AvMultitrackTypeOneTrack<<4 | head[0]&0x0F}
+	mt = append(mt, head[1:5]...)
+	mt = append(mt, trackID)
+	return append(mt, head[5:]...)
+}
+
+// exHeader 返回替换旧格式标签头的Enhanced RTMP标签头和被替换的旧标签头长度，不需要转换时返回nil
+func (av *AVSender) exHeader(legacy []byte) (head []byte, n int) {
+	if av.fourCC == "" {
+		return nil, 0
+	}
+	if av.MessageTypeID == RTMP_MSG_VIDEO {
+		if len(legacy) < 5 {
+			return nil, 0
+		}
+		head, n = exVideoHeader(av.fourCC, legacy[:5]), 5
+		if av.multitrack {
+			head = multitrackHeader(head, PacketTypeMultitrack, av.trackID)
+		}
+		return
+	}
+	if len(legacy) < 2 {
+		return nil, 0
+	}
+	head, n = exAudioHeader(av.fourCC, legacy)
+	if av.multitrack {
+		head = multitrackHeader(head, AudioPacketTypeMultitrack, av.trackID)
+	}
+	return
+}
+
+// exTag 把旧格式的标签转换为Enhanced RTMP格式
+func (av *AVSender) exTag(tag []byte) []byte {
+	head, n := av.exHeader(tag)
+	if head == nil {
+		return tag
+	}
+	return append(head, tag[n:]...)
+}
+
+// legacyHeader 帧的前5个字节，不足5个字节时返回整个帧
+func legacyHeader(frame *common.AVFrame) []byte {
+	n := 5
+	if frame.AVCC.ByteLength < n {
+		n = frame.AVCC.ByteLength
+	}
+	head := make([]byte, n)
+	for i := range head {
+		head[i] = frame.AVCC.GetByte(i)
+	}
+	return head
+}
@@ -0,0 +1,161 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// 推流端发送的ExVideoTagHeader，来自OBS 30和ffmpeg 7的抓包
+func TestToLegacyVideoTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		head    string // 为空表示不转换
+		payload string
+	}{
+		{"hevc sequence start", "90 68766331 01 01 60 00 00 00 b0 00 00 00 00 00 5d f0 00 fc fd f8 f8 00 00 0f 03",
+			"1c 00 000000", "01 01 60 00 00 00 b0 00 00 00 00 00 5d f0 00 fc fd f8 f8 00 00 0f 03"},
+		{"hevc keyframe with cts", "91 68766331 000042 00000005 26 01 af 09 40", "1c 01 000042", "00000005 26 01 af 09 40"},
+		{"hevc coded frames x", "a3 68766331 00000004 02 01 d0 09", "2c 01 000000", "00000004 02 01 d0 09"},
+		{"avc inter frame with cts", "a1 61766331 000028 00000002 41 9a", "27 01 000028", "00000002 41 9a"},
+		{"av1 sequence start", "90 61763031 81 00 0c 00 0a 0b 00 00 00 24 c4 ff df 00 68 02",
+			"1d 00 000000", "81 00 0c 00 0a 0b 00 00 00 24 c4 ff df 00 68 02"},
+		{"av1 coded frames without cts", "91 61763031 12 00 0a 0a", "1d 01 000000", "12 00 0a 0a"},
+		{"hevc truncated cts", "91 68766331 0000", "", ""},
+		{"hevc sequence end", "92 68766331", "", ""},
+		{"av1 mpeg2ts sequence start", "95 61763031 80 04 01 2d", "", ""},
+		{"vp9 passthrough", "90 76703039 01 00 00 00 02 01 00 01", "", ""},
+		{"command frame", "d1 61766331 00", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := unhex(tt.tag)
+			if !isExHeader(data[0]) {
+				t.Fatal("not an ExVideoTagHeader")
+			}
+			frameType, packetType := data[0]>>4&0b0111, data[0]&0b1111
+			head, payload, ok := toLegacyVideoTag(frameType, packetType, string(data[1:5]), data[5:])
+			if tt.head == "" {
+				if ok {
+					t.Fatalf("converted to %x %x", head, payload)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("not converted")
+			}
+			if !bytes.Equal(head, unhex(tt.head)) || !bytes.Equal(payload, unhex(tt.payload)) {
+				t.Fatalf("got %x %x, want %s %s", head, payload, tt.head, tt.payload)
+			}
+		})
+	}
+}
+
+func TestExVideoTag(t *testing.T) {
+	tests := []struct {
+		name       string
+		fourCC     string
+		multitrack bool
+		legacy     string
+		want       string
+	}{
+		{"hevc sequence start", FourCC_HEVC, false, "1c 00 000000 01 01 60", "90 68766331 01 01 60"},
+		{"hevc keyframe with cts", FourCC_HEVC, false, "1c 01 000042 00000005 26", "91 68766331 000042 00000005 26"},
+		{"hevc zero cts uses coded frames x", FourCC_HEVC, false, "2c 01 000000 00000004 02", "a3 68766331 00000004 02"},
+		{"hevc sequence end", FourCC_HEVC, false, "1c 02 000000", "92 68766331"},
+		{"av1 never carries cts", FourCC_AV1, false, "1d 01 000010 12 00", "93 61763031 12 00"},
+		{"av1 sequence start", FourCC_AV1, false, "1d 00 000000 81 00 0c", "90 61763031 81 00 0c"},
+		{"hevc multitrack", FourCC_HEVC, true, "1c 01 000042 00000005 26", "96 01 68766331 01 000042 00000005 26"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			av := &AVSender{fourCC: tt.fourCC, multitrack: tt.multitrack, trackID: 1}
+			av.MessageTypeID = RTMP_MSG_VIDEO
+			if got := av.exTag(unhex(tt.legacy)); !bytes.Equal(got, unhex(tt.want)) {
+				t.Fatalf("got %x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// 转换为Enhanced RTMP发送后再接收，应该得到原来的旧格式标签
+func TestExVideoTagRoundTrip(t *testing.T) {
+	for _, legacy := range []string{"1c 00 000000 01 01 60", "1c 01 000042 00000005 26", "2c 01 000000 00000004 02", "17 01 000028 00000002 65", "1d 01 000000 12 00"} {
+		data := unhex(legacy)
+		fourCC := FourCC_AVC
+		switch data[0] & 0x0F {
+		case 12:
+			fourCC = FourCC_HEVC
+		case 13:
+			fourCC = FourCC_AV1
+		}
+		av := &AVSender{fourCC: fourCC}
+		av.MessageTypeID = RTMP_MSG_VIDEO
+		ex := av.exTag(data)
+		head, payload, ok := toLegacyVideoTag(ex[0]>>4&0b0111, ex[0]&0b1111, string(ex[1:5]), ex[5:])
+		if !ok || !bytes.Equal(append(head, payload...), data) {
+			t.Errorf("%s: got %x %x via %x", legacy, head, payload, ex)
+		}
+	}
+}
+
+func TestSplitMultitrack(t *testing.T) {
+	packetType, tracks, err := splitMultitrack(unhex("11 68766331 00 000003 aabbcc 01 000002 ddee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packetType != PacketTypeCodedFrames || len(tracks) != 2 {
+		t.Fatalf("packetType %d, %d tracks", packetType, len(tracks))
+	}
+	for i, want := range []trackPacket{{FourCC_HEVC, 0, unhex("aabbcc")}, {FourCC_HEVC, 1, unhex("ddee")}} {
+		if got := tracks[i]; got.fourCC != want.fourCC || got.trackID != want.trackID || !bytes.Equal(got.data, want.data) {
+			t.Errorf("track %d: got %+v, want %+v", i, got, want)
+		}
+	}
+	if _, _, err = splitMultitrack(unhex("11 68766331 00 000005 aabb")); err == nil {
+		t.Error("truncated packet accepted")
+	}
+}
+
+func TestFourCcInfo(t *testing.T) {
+	if fourCcInfo(FourCC_VP9) != FourCcInfoCanForward {
+		t.Error("vp09 should only be forwarded")
+	}
+	if fourCcInfo(FourCC_HEVC) != FourCcInfoCanDecode|FourCcInfoCanForward {
+		t.Error("hvc1 should be decoded and forwarded")
+	}
+	for _, f := range []string{FourCC_FLAC, FourCC_AC3, FourCC_EAC3} {
+		if fourCcInfo(f) != FourCcInfoCanForward {
+			t.Errorf("%s should only be forwarded", f)
+		}
+	}
+}
+
+func TestIsAuxConfig(t *testing.T) {
+	tests := []struct {
+		tag   string
+		video bool
+		want  bool
+	}{
+		{"95 61763031 80 04", true, true},           // AV1 MPEG2TSSequenceStart
+		{"90 76703039 01 00", true, false},          // VP9 SequenceStart
+		{"94 664c6143 01 02 00000003", false, true}, // FLAC MultichannelConfig
+		{"90 664c6143 00 00 00 22", false, false},   // FLAC SequenceStart
+		{"91 61632d33 0b 77", false, false},         // AC-3 CodedFrames
+	}
+	for _, tt := range tests {
+		if got := isAuxConfig(unhex(tt.tag), tt.video); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+}
@@ -74,7 +74,8 @@ func ReadBuf(r io.Reader, length int) (buf []byte) {
 
 func (nc *NetConnection) Handshake() error {
 	C0C1 := ReadBuf(nc.Reader, C1S1_SIZE+1)
-	if C0C1[0] != RTMP_HANDSHAKE_VERSION {
+	version := C0C1[0]
+	if version != RTMP_HANDSHAKE_VERSION && version != RTMPE_HANDSHAKE_VERSION {
 		return errors.New("C0 Error")
 	}
 	var C1 = C0C1[1:]
@@ -85,10 +86,14 @@ func (nc *NetConnection) Handshake() error {
 	util.GetBE(C1[4:8], &ts)
 
 	if ts == 0 {
+		// RTMPE需要在complex handshake中交换DH公钥
+		if version == RTMPE_HANDSHAKE_VERSION {
+			return errors.New("RTMPE requires complex handshake")
+		}
 		return nc.simple_handshake(C1)
 	}
 
-	return nc.complex_handshake(C1)
+	return nc.complex_handshake(C1, version)
 }
 
 func (client *NetConnection) ClientHandshake() (err error) {
@@ -121,7 +126,8 @@ func (nc *NetConnection) simple_handshake(C1 []byte) error {
 	return nil
 }
 
-func (nc *NetConnection) complex_handshake(C1 []byte) error {
+// complex_handshake version为RTMPE时，S1的key中放置DH公钥，C2之后开启RC4加密
+func (nc *NetConnection) complex_handshake(C1 []byte, version byte) error {
 	// 验证客户端,digest偏移位置和scheme由客户端定.
 	scheme, challenge, digest, ok, err := validateClient(C1)
 	if err != nil {
@@ -135,6 +141,14 @@ func (nc *NetConnection) complex_handshake(C1 []byte) error {
 
 	// s1
 	S1 := create_S1()
+	var dh *dhKey
+	if version == RTMPE_HANDSHAKE_VERSION {
+		// 客户端的challenge就是它的DH公钥
+		if dh, err = newDHKey(); err != nil {
+			return err
+		}
+		copy(S1[scheme_Key_Offset(S1, scheme):], dh.public)
+	}
 	S1_Digest_Offset := scheme_Digest_Offset(S1, scheme)
 	S1_Part1 := S1[:S1_Digest_Offset]
 	S1_Part2 := S1[S1_Digest_Offset+C1S1_DIGEST_DATA_SIZE:]
@@ -168,10 +182,13 @@ func (nc *NetConnection) complex_handshake(C1 []byte) error {
 		return err
 	}
 
-	buffer := net.Buffers{[]byte{RTMP_HANDSHAKE_VERSION}, S1, S2_Random, S2_Digest}
+	buffer := net.Buffers{[]byte{version}, S1, S2_Random, S2_Digest}
 	buffer.WriteTo(nc)
 
 	ReadBuf(nc.Reader, 1536)
+	if dh != nil {
+		return nc.encrypt(dh, challenge)
+	}
 	return nil
 }
 
@@ -240,6 +257,16 @@ func scheme_Digest_Offset(C1S1 []byte, scheme int) int {
 	return -1
 }
 
+func scheme_Key_Offset(C1S1 []byte, scheme int) int {
+	if scheme == 0 {
+		return scheme0_Key_Offset(C1S1)
+	} else if scheme == 1 {
+		return scheme1_Key_Offset(C1S1)
+	}
+
+	return -1
+}
+
 // scheme0:
 // time + version + digest 										  + key
 // time + version + [offset + random + digest-data + random-data] + key
@@ -294,7 +321,7 @@ func scheme1_Digest_Offset(C1S1 []byte) int {
 func scheme1_Key_Offset(C1S1 []byte) int {
 	scheme1_key_offset := int(C1S1[768]) + int(C1S1[769]) + int(C1S1[770]) + int(C1S1[771])
 
-	scheme1_key_offset = (scheme1_key_offset % C1S1_KEY_OFFSET_MAX) + C1S1_TIME_SIZE + C1S1_VERSION_SIZE + C1S1_DIGEST_SIZE
+	scheme1_key_offset = (scheme1_key_offset % C1S1_KEY_OFFSET_MAX) + C1S1_TIME_SIZE + C1S1_VERSION_SIZE
 	if scheme1_key_offset+128 >= C1S1_SIZE {
 		// key error
 	}
@@ -0,0 +1,183 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+const (
+	HookConnect   = "connect"
+	HookPublish   = "publish"
+	HookUnpublish = "unpublish"
+	HookPlay      = "play"
+	HookStop      = "stop"
+	HookClose     = "close"
+)
+
+// HookConfig 类似nginx-rtmp的on_publish/on_play回调，为空则不回调
+type HookConfig struct {
+	OnConnect   string        `desc:"connect回调地址"`
+	OnPublish   string        `desc:"推流回调地址"`
+	OnUnpublish string        `desc:"停止推流回调地址"`
+	OnPlay      string        `desc:"播放回调地址"`
+	OnStop      string        `desc:"停止播放回调地址"`
+	OnClose     string        `desc:"连接断开回调地址"`
+	Timeout     time.Duration `default:"3s" desc:"回调超时时间，包括重试在内的总时间"`
+	Retry       int           `desc:"回调请求失败或者返回5xx时的重试次数"`
+	FailOpen    bool          `desc:"回调请求失败（非拒绝）时是否放行"`
+}
+
+// HookEvent 回调时POST的JSON内容
+type HookEvent struct {
+	Action    string     `json:"action"`
+	Vhost     string     `json:"vhost,omitempty"`
+	App       string     `json:"app"`
+	Stream    string     `json:"stream,omitempty"`
+	Args      url.Values `json:"args,omitempty"`
+	TcUrl     string     `json:"tcUrl,omitempty"`
+	ClientIP  string     `json:"clientIP"`
+	FlashVer  string     `json:"flashVer,omitempty"`
+	SessionID string     `json:"sessionID"`
+}
+
+func newHookEvent(action string, info *ConnectInfo) *HookEvent {
+	e := &HookEvent{
+		Action:    action,
+		Vhost:     info.Vhost,
+		App:       info.App,
+		TcUrl:     info.TcUrl,
+		ClientIP:  info.IP(),
+		SessionID: info.SessionID,
+	}
+	e.FlashVer, _ = info.Object["flashVer"].(string)
+	return e
+}
+
+func (info *StreamInfo) hookEvent(action string) *HookEvent {
+	e := newHookEvent(action, info.ConnectInfo)
+	e.Stream = info.StreamName
+	e.Args = info.Args
+	return e
+}
+
+// ErrHookRejected 回调服务返回了非2xx、3xx、5xx的状态码
+var ErrHookRejected = errors.New("rejected by hook")
+
+// hookBackoff 第一次重试前的等待时间，之后每次加倍
+var hookBackoff = 100 * time.Millisecond
+
+func (c *HookConfig) hookURL(action string) string {
+	switch action {
+	case HookConnect:
+		return c.OnConnect
+	case HookPublish:
+		return c.OnPublish
+	case HookUnpublish:
+		return c.OnUnpublish
+	case HookPlay:
+		return c.OnPlay
+	case HookStop:
+		return c.OnStop
+	case HookClose:
+		return c.OnClose
+	}
+	return ""
+}
+
+// Call 同步回调，返回3xx时redirect为Location头的内容，用于重定向连接或重命名流。
+// 请求失败或者返回5xx时按指数退避重试，包括重试在内不超过Timeout，避免长时间阻塞连接
+func (c *HookConfig) Call(e *HookEvent) (redirect string, err error) {
+	target := c.hookURL(e.Action)
+	if target == "" {
+		return "", nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	res, err := c.post(ctx, target, body, e.Action)
+	if err != nil {
+		if c.FailOpen {
+			return "", nil
+		}
+		return "", err
+	}
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return "", nil
+	case res.StatusCode >= 300 && res.StatusCode < 400:
+		if redirect = res.Header.Get("Location"); redirect != "" {
+			// connect重定向到其他地址，publish和play只能改为同一应用中的其他流名称
+			if e.Action != HookConnect && !validStreamName(redirect) {
+				return "", fmt.Errorf("%w: invalid stream name %q", ErrHookRejected, redirect)
+			}
+			return redirect, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrHookRejected, res.Status)
+}
+
+// validStreamName 回调返回的流名称不能带路径和参数，否则可以跳出应用，或者绕过鉴权时使用的streamPath
+func validStreamName(name string) bool {
+	if name == "" || name == "." || strings.Contains(name, "..") {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\?#") && strings.IndexFunc(name, unicode.IsControl) < 0
+}
+
+// post 发送回调请求，请求失败或者返回5xx时重试
+func (c *HookConfig) post(ctx context.Context, target string, body []byte, action string) (res *http.Response, err error) {
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	backoff := hookBackoff
+	for i := 0; ; i++ {
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body)); err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if res, err = client.Do(req); err == nil {
+			res.Body.Close()
+			if res.StatusCode < 500 {
+				return
+			}
+			err = fmt.Errorf("hook server error: %s", res.Status)
+		}
+		RTMPPlugin.Warn("hook", zap.String("action", action), zap.String("url", target), zap.Int("try", i+1), zap.Error(err))
+		if i >= c.Retry {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Notify 异步回调，忽略结果
+func (c *HookConfig) Notify(e *HookEvent) {
+	if c.hookURL(e.Action) != "" {
+		go c.Call(e)
+	}
+}
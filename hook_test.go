@@ -0,0 +1,117 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setHookBackoff 缩短重试间隔，测试结束后恢复
+func setHookBackoff(t *testing.T, d time.Duration) {
+	old := hookBackoff
+	hookBackoff = d
+	t.Cleanup(func() {
+		hookBackoff = old
+	})
+}
+
+func TestHookCall(t *testing.T) {
+	setHookBackoff(t, 10*time.Millisecond)
+	tests := []struct {
+		name     string
+		statuses []int // 依次返回的状态码，最后一个重复使用
+		location string
+		retry    int
+		failOpen bool
+		redirect string
+		calls    int32
+		err      error
+	}{
+		{name: "allow", statuses: []int{http.StatusOK}, calls: 1},
+		{name: "veto", statuses: []int{http.StatusForbidden}, retry: 2, calls: 1, err: ErrHookRejected},
+		{name: "redirect", statuses: []int{http.StatusFound}, location: "other", redirect: "other", calls: 1},
+		{name: "redirect without location", statuses: []int{http.StatusFound}, calls: 1, err: ErrHookRejected},
+		{name: "redirect to another app", statuses: []int{http.StatusFound}, location: "../other/test", calls: 1, err: ErrHookRejected},
+		{name: "redirect with path", statuses: []int{http.StatusFound}, location: "sub/test", calls: 1, err: ErrHookRejected},
+		{name: "redirect with query", statuses: []int{http.StatusFound}, location: "test?key=abc", calls: 1, err: ErrHookRejected},
+		{name: "redirect to dot dot", statuses: []int{http.StatusFound}, location: "..", calls: 1, err: ErrHookRejected},
+		{name: "retry 5xx", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, retry: 2, calls: 3},
+		{name: "retry exhausted", statuses: []int{http.StatusServiceUnavailable}, retry: 2, calls: 3, err: errAny},
+		{name: "fail open", statuses: []int{http.StatusInternalServerError}, retry: 1, failOpen: true, calls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var e HookEvent
+				if err := json.NewDecoder(r.Body).Decode(&e); err != nil || e.Action != HookPublish || e.Stream != "test" {
+					t.Errorf("unexpected body %+v, %v", e, err)
+				}
+				i := int(calls.Add(1)) - 1
+				if i >= len(tt.statuses) {
+					i = len(tt.statuses) - 1
+				}
+				if tt.location != "" {
+					w.Header().Set("Location", tt.location)
+				}
+				w.WriteHeader(tt.statuses[i])
+			}))
+			defer srv.Close()
+			c := &HookConfig{OnPublish: srv.URL, Timeout: 3 * time.Second, Retry: tt.retry, FailOpen: tt.failOpen}
+			info := newStreamInfo(&ConnectInfo{App: "live", RemoteAddr: "127.0.0.1:1234"}, "live", "test?key=abc")
+			redirect, err := c.Call(info.hookEvent(HookPublish))
+			switch {
+			case tt.err == errAny:
+				if err == nil {
+					t.Fatal("expected error")
+				}
+			case !errors.Is(err, tt.err):
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if redirect != tt.redirect {
+				t.Errorf("redirect = %q, want %q", redirect, tt.redirect)
+			}
+			if n := calls.Load(); n != tt.calls {
+				t.Errorf("calls = %d, want %d", n, tt.calls)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+// 后端一直不可用时，重试的总时间不超过Timeout
+func TestHookCallTimeout(t *testing.T) {
+	setHookBackoff(t, 50*time.Millisecond)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	c := &HookConfig{OnConnect: srv.URL, Timeout: 200 * time.Millisecond, Retry: 100}
+	start := time.Now()
+	if _, err := c.Call(newHookEvent(HookConnect, &ConnectInfo{App: "live"})); err == nil {
+		t.Fatal("expected error")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("call took %v", d)
+	}
+}
+
+func TestHookCallUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+	c := &HookConfig{OnPlay: url, Timeout: time.Second}
+	e := newHookEvent(HookPlay, &ConnectInfo{App: "live"})
+	if _, err := c.Call(e); err == nil {
+		t.Fatal("expected error when fail closed")
+	}
+	c.FailOpen = true
+	if _, err := c.Call(e); err != nil {
+		t.Fatalf("fail open: %v", err)
+	}
+}
@@ -2,8 +2,10 @@ package rtmp
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
@@ -18,8 +20,19 @@ type RTMPConfig struct {
 	config.TCP
 	config.Pull
 	config.Push
-	ChunkSize int  `default:"65535" desc:"分片大小"`
-	KeepAlive bool `desc:"保持连接，流断开不关闭连接"` //保持rtmp连接，默认随着stream的close而主动断开
+	ChunkSize       int                    `default:"65535" desc:"分片大小"`
+	KeepAlive       bool                   `desc:"保持连接，流断开不关闭连接"` //保持rtmp连接，默认随着stream的close而主动断开
+	PublishAuth     AuthConfig             `desc:"推流鉴权"`
+	PlayAuth        AuthConfig             `desc:"播放鉴权"`
+	Hook            HookConfig             `desc:"回调"`
+	Apps            map[string]AppConfig   `desc:"应用配置，key为应用名或通配符，配置后只允许连接已配置的应用"`
+	Vhosts          map[string]VhostConfig `desc:"虚拟主机配置，key为vhost或通配符"`
+	DVR             DVRConfig              `desc:"时移"`
+	PlayWaitTimeout time.Duration          `default:"10s" desc:"play的start为-2时等待发布者的超时时间"`
+	Aggregate       int                    `desc:"播放时把多个小帧合并为不超过该字节数的聚合消息，0表示不合并"`
+	AggregateDelay  time.Duration          `default:"100ms" desc:"聚合消息中的帧的最大时间跨度，没有后续的帧时最多等待该时长后发送"`
+	SharedObjectDir string                 `desc:"持久化的远程共享对象保存的目录，为空时只保存在内存中"`
+	DataRelay       []string               `desc:"推流端通过NetStream.send发送的数据消息中转发给播放端和转推的处理函数名，支持通配符"`
 }
 
 func pull(streamPath, url string) {
@@ -41,6 +54,9 @@ func (c *RTMPConfig) OnEvent(event any) {
 			go c.ListenTCP(RTMPPlugin, c)
 		}
 	case SEpublish:
+		if c.DVR.match(v.Target.Path) {
+			go startDVR(v.Target.Path, c.DVR)
+		}
 		if remoteURL := conf.CheckPush(v.Target.Path); remoteURL != "" {
 			if err := RTMPPlugin.Push(v.Target.Path, remoteURL, new(RTMPPusher), false); err != nil {
 				RTMPPlugin.Error("push", zap.String("streamPath", v.Target.Path), zap.String("url", remoteURL), zap.Error(err))
@@ -54,7 +70,8 @@ func (c *RTMPConfig) OnEvent(event any) {
 }
 
 var conf = &RTMPConfig{
-	TCP: config.TCP{ListenAddr: ":1935"},
+	TCP:       config.TCP{ListenAddr: ":1935"},
+	DataRelay: []string{"onCuePoint", "onTextData", "onCaptionInfo"},
 }
 
 var RTMPPlugin = InstallPlugin(conf)
@@ -91,3 +108,31 @@ func (*RTMPConfig) API_Push(rw http.ResponseWriter, r *http.Request) {
 		util.ReturnOK(rw, r)
 	}
 }
+
+// API_inject 向流中插入数据消息，在timestamp（流的时间戳，毫秒）处发送给所有rtmp播放端和转推，没有timestamp时在下一帧之前发送
+func (*RTMPConfig) API_inject(rw http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	if Streams.Get(streamPath) == nil {
+		util.ReturnError(util.APIErrorNoStream, streamPath+" not found", rw, r)
+		return
+	}
+	var req struct {
+		Handler   string  `json:"handler"`
+		Timestamp *uint32 `json:"timestamp"`
+		Payload   any     `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), rw, r)
+		return
+	}
+	if req.Handler == "" {
+		util.ReturnError(util.APIErrorQueryParse, "handler required", rw, r)
+		return
+	}
+	n, err := injectData(streamPath, req.Handler, req.Timestamp, req.Payload)
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), rw, r)
+		return
+	}
+	util.ReturnValue(n, rw, r)
+}
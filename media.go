@@ -4,6 +4,8 @@ import (
 	"errors"
 	"net"
 	"runtime"
+	"sync"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
@@ -13,22 +15,75 @@ import (
 type AVSender struct {
 	*RTMPSender
 	ChunkHeader
-	firstSent bool
+	firstSent    atomic.Bool // 发送时移缓冲、聚合消息后置为false，之后的帧使用绝对时间戳
+	seqHeadSent  atomic.Bool
+	seqHead      []byte      // 最近的序列头，重新开启接收时发送，持有写锁时访问
+	muted        atomic.Bool // receiveAudio/receiveVideo关闭
+	unmuting     atomic.Bool
+	fourCC       string // 使用Enhanced RTMP发送时的FourCC，为空则使用旧格式
+	multitrack   bool   // 以Multitrack包发送附加轨道
+	formatChosen bool
+	trackID      byte
 }
 
 func (av *AVSender) sendSequenceHead(seqHead []byte) {
-	av.SetTimestamp(0)
-	av.MessageLength = uint32(len(seqHead))
 	for !av.writing.CompareAndSwap(false, true) {
 		runtime.Gosched()
 	}
 	defer av.writing.Store(false)
-	if av.firstSent {
+	av.writeSequenceHead(seqHead)
+}
+
+// lastSequenceHead 返回最近发送的序列头
+func (av *AVSender) lastSequenceHead() []byte {
+	for !av.writing.CompareAndSwap(false, true) {
+		runtime.Gosched()
+	}
+	defer av.writing.Store(false)
+	return av.seqHead
+}
+
+// sendSequenceHeads 发送序列头，之前先发送元数据。
+// 序列头变化、重新开启接收、时移和play2切换都经过这里，使客户端在新的序列头之前收到对应的元数据
+func (rtmp *RTMPSender) sendSequenceHeads(audioSeq, videoSeq []byte) {
+	resend := audioSeq != nil && rtmp.audio.seqHeadSent.Load() || videoSeq != nil && rtmp.video.seqHeadSent.Load()
+	if resend || !rtmp.metaSent.Load() {
+		rtmp.sendMetaData()
+	}
+	if audioSeq != nil {
+		rtmp.audio.sendSequenceHead(audioSeq)
+	}
+	if videoSeq != nil {
+		rtmp.video.sendSequenceHead(videoSeq)
+	}
+}
+
+// writeSequenceHead 需要持有写锁，时移协程和发送帧的协程共用消息头
+func (av *AVSender) writeSequenceHead(seqHead []byte) {
+	av.seqHeadSent.Store(true)
+	av.seqHead = seqHead
+	if av.muted.Load() {
+		return
+	}
+	av.writeTag(av.exTag(seqHead))
+	// AV1的MPEG2TSSequenceStart、Opus的MultichannelConfig随序列头发送
+	if av.fourCC != "" && !av.multitrack {
+		if tag := findPassthroughConfig(av.Stream.Path, auxConfigKey(av.fourCC)); tag != nil {
+			av.writeTag(tag)
+		}
+	}
+}
+
+// writeTag 以时间戳0发送序列头等配置标签，需要持有写锁
+func (av *AVSender) writeTag(tag []byte) {
+	av.SetTimestamp(0)
+	av.MessageLength = uint32(len(tag))
+	if av.firstSent.Load() {
 		av.WriteTo(RTMP_CHUNK_HEAD_8, &av.chunkHeader)
 	} else {
 		av.WriteTo(RTMP_CHUNK_HEAD_12, &av.chunkHeader)
 	}
-	av.sendChunk(seqHead)
+	av.sendChunk(tag)
 }
 
 func (av *AVSender) sendFrame(frame *common.AVFrame, absTime uint32) (err error) {
@@ -39,22 +94,26 @@ func (av *AVSender) sendFrame(frame *common.AVFrame, absTime uint32) (err error)
 		av.Error("payload is empty", zap.Error(err))
 		return err
 	}
+	exHead, legacyLen := av.exHeader(legacyHeader(frame))
+	if exHead != nil {
+		payloadLen += len(exHead) - legacyLen
+	}
 	if av.writeSeqNum > av.bandwidth {
 		av.totalWrite += av.writeSeqNum
 		av.writeSeqNum = 0
 		av.SendMessage(RTMP_MSG_ACK, Uint32Message(av.totalWrite))
 		av.SendStreamID(RTMP_USER_PING_REQUEST, 0)
 	}
-	av.MessageLength = uint32(payloadLen)
 	for !av.writing.CompareAndSwap(false, true) {
 		runtime.Gosched()
 	}
 	defer av.writing.Store(false)
+	av.MessageLength = uint32(payloadLen)
 	// 第一次是发送关键帧,需要完整的消息头(Chunk Basic Header(1) + Chunk Message Header(11) + Extended Timestamp(4)(可能会要包括))
 	// 后面开始,就是直接发送音视频数据,那么直接发送,不需要完整的块(Chunk Basic Header(1) + Chunk Message Header(7))
 	// 当Chunk Type为0时(即Chunk12),
-	if !av.firstSent {
-		av.firstSent = true
+	if !av.firstSent.Load() {
+		av.firstSent.Store(true)
 		av.SetTimestamp(absTime)
 		av.WriteTo(RTMP_CHUNK_HEAD_12, &av.chunkHeader)
 	} else {
@@ -67,7 +126,14 @@ func (av *AVSender) sendFrame(frame *common.AVFrame, absTime uint32) (err error)
 	}
 	r := frame.AVCC.NewReader()
 	chunk := net.Buffers{av.chunkHeader}
-	av.writeSeqNum += uint32(av.chunkHeader.Len() + r.WriteNTo(av.writeChunkSize, &chunk))
+	firstSize := av.writeChunkSize
+	if exHead != nil {
+		r.Skip(legacyLen)
+		chunk = append(chunk, exHead)
+		firstSize -= len(exHead)
+		av.writeSeqNum += uint32(len(exHead))
+	}
+	av.writeSeqNum += uint32(av.chunkHeader.Len() + r.WriteNTo(firstSize, &chunk))
 	for r.CanRead() {
 		item := av.bytePool.Get(16)
 		defer item.Recycle()
@@ -83,7 +149,29 @@ func (av *AVSender) sendFrame(frame *common.AVFrame, absTime uint32) (err error)
 type RTMPSender struct {
 	Subscriber
 	NetStream
-	audio, video AVSender
+	audio, video   AVSender
+	paused         atomic.Bool
+	resuming       atomic.Bool   // 已恢复直播但还没有发送帧
+	timeshifting   atomic.Bool   // 正在播放时移缓冲，丢弃直播帧
+	dvrGen         atomic.Uint32 // 每次Seek、GoLive递增，用于结束之前的时移协程
+	clock          playClock
+	duration       uint32      // play的duration，毫秒，0表示不限制
+	completed      atomic.Bool // 已达到duration
+	switching      *RTMPSender // play2切换时被替换的订阅者，切换完成前缓存序列头
+	switched       atomic.Bool // 已被play2切换到的订阅者替换
+	switchPending  atomic.Bool // play2切换还没有完成，处理命令的协程通过它判断，不读取switching
+	audioSeq       []byte
+	videoSeq       []byte
+	metaSent       atomic.Bool
+	aggregate      aggregator
+	data           AVSender    // 转发推流端的数据消息
+	dataQueue      []dataFrame // 等待与音视频一起按时间戳发送的数据消息
+	dataLock       sync.Mutex
+	captionMode    string          // 播放参数captions，字幕的发送格式
+	captions       [][]byte        // sei模式下等待插入视频帧的字幕
+	naluLengthSize int             // 视频序列头中NALU长度的字节数
+	passSent       map[string]bool // 已发送SequenceStart的原样转发的编码，只在发送原样转发标签的协程中访问
+	passQueue      chan dataFrame  // 等待发送的原样转发标签，持有dataRelay的锁时创建和关闭
 }
 
 func (rtmp *RTMPSender) OnEvent(event any) {
@@ -101,18 +189,85 @@ func (rtmp *RTMPSender) OnEvent(event any) {
 		rtmp.video.MessageTypeID = RTMP_MSG_VIDEO
 		rtmp.audio.MessageStreamID = rtmp.StreamID
 		rtmp.video.MessageStreamID = rtmp.StreamID
+		rtmp.aggregate.RTMPSender = rtmp
+		rtmp.aggregate.ChunkStreamID = RTMP_CSID_AGGREGATE
+		rtmp.aggregate.MessageTypeID = RTMP_MSG_AGGREGATE
+		rtmp.aggregate.MessageStreamID = rtmp.StreamID
+		rtmp.data.RTMPSender = rtmp
+		rtmp.data.ChunkStreamID = RTMP_CSID_USERDATA
+		rtmp.data.MessageTypeID = RTMP_MSG_AMF0_METADATA
+		rtmp.data.MessageStreamID = rtmp.StreamID
+		rtmp.joinDataRelay()
+	case SEclose:
+		rtmp.aggregate.close()
+		rtmp.leaveDataRelay()
+		rtmp.Subscriber.OnEvent(event)
 	case AudioDeConf:
-		rtmp.audio.sendSequenceHead(v)
+		if err := rtmp.chooseAudioFormat(); err != nil {
+			rtmp.playFailed(err)
+			return
+		}
+		if rtmp.switching != nil {
+			rtmp.audioSeq = append([]byte(nil), v...)
+			return
+		}
+		rtmp.aggregate.flush()
+		rtmp.sendSequenceHeads(v, nil)
 	case VideoDeConf:
-		rtmp.video.sendSequenceHead(v)
+		if err := rtmp.chooseVideoFormat(); err != nil {
+			rtmp.playFailed(err)
+			return
+		}
+		rtmp.naluLengthSize = avcNALULengthSize(v)
+		if rtmp.switching != nil {
+			rtmp.videoSeq = append([]byte(nil), v...)
+			return
+		}
+		rtmp.aggregate.flush()
+		rtmp.sendSequenceHeads(nil, v)
 	case AudioFrame:
-		if err := rtmp.audio.sendFrame(v.AVFrame, v.AbsTime); err != nil {
+		// Opus等没有序列头的编码在第一帧时选择格式
+		if !rtmp.audio.formatChosen {
+			if err := rtmp.chooseAudioFormat(); err != nil {
+				rtmp.playFailed(err)
+				return
+			}
+		}
+		if rtmp.switching != nil && !rtmp.completeSwitch(v.AVFrame, false) {
+			return
+		}
+		ts, ok := rtmp.canSend(v.AVFrame, v.AbsTime, false)
+		rtmp.sendData(v.AVFrame, ok)
+		if !ok {
+			rtmp.aggregate.flush()
+			return
+		}
+		if !rtmp.audio.receiving(false) {
+			return
+		}
+		if err := rtmp.send(&rtmp.audio, v.AVFrame, ts); err != nil {
 			rtmp.Stop(zap.Error(err))
+			return
 		}
+		rtmp.checkDuration()
 	case VideoFrame:
-		if err := rtmp.video.sendFrame(v.AVFrame, v.AbsTime); err != nil {
+		if rtmp.switching != nil && !rtmp.completeSwitch(v.AVFrame, true) {
+			return
+		}
+		ts, ok := rtmp.canSend(v.AVFrame, v.AbsTime, true)
+		rtmp.sendData(v.AVFrame, ok)
+		if !ok {
+			rtmp.aggregate.flush()
+			return
+		}
+		if !rtmp.video.receiving(v.IFrame) {
+			return
+		}
+		if err := rtmp.sendVideo(v.AVFrame, ts); err != nil {
 			rtmp.Stop(zap.Error(err))
+			return
 		}
+		rtmp.checkDuration()
 	default:
 		rtmp.Subscriber.OnEvent(event)
 	}
@@ -134,6 +289,12 @@ func (r *RTMPSender) Response(tid uint64, code, level string) error {
 type RTMPReceiver struct {
 	Publisher
 	NetStream
+	audioTracks   map[byte]common.AVTrack // Multitrack中trackId不为0的附加轨道
+	videoTracks   map[byte]common.AVTrack
+	metadata      atomic.Pointer[MetaData] // 推流端发送的元数据
+	passConfigs   sync.Map                 // 原样转发的编码的配置标签，见passthrough.go
+	audioChannels byte                     // MultichannelConfig中的声道数
+	captions      captionState             // 检测到的字幕，见captions.go
 }
 
 func (r *RTMPReceiver) OnEvent(event any) {
@@ -163,14 +324,19 @@ func (r *RTMPReceiver) Response(tid uint64, code, level string) error {
 }
 
 func (r *RTMPReceiver) ReceiveAudio(msg *Chunk) {
-	if r.AudioTrack == nil {
-		r.WriteAVCCAudio(0, &msg.AVData, r.bytePool)
+	if msg.AVData.ByteLength > 0 && msg.AVData.GetByte(0)>>4 == SoundFormatExHeader && !r.exAudioToLegacy(msg) {
+		msg.AVData.Recycle()
 		return
 	}
-	r.AudioTrack.WriteAVCC(msg.ExtendTimestamp, &msg.AVData)
+	r.writeAudio(msg.ExtendTimestamp, &msg.AVData)
 }
 
 func (r *RTMPReceiver) ReceiveVideo(msg *Chunk) {
+	if msg.AVData.ByteLength > 0 && isExHeader(msg.AVData.GetByte(0)) && !r.exVideoToLegacy(msg) {
+		msg.AVData.Recycle()
+		return
+	}
+	r.detectCaptionSEI(msg.ExtendTimestamp, &msg.AVData)
 	if r.VideoTrack == nil {
 		r.WriteAVCCVideo(0, &msg.AVData, r.bytePool)
 		return
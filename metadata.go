@@ -0,0 +1,199 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"net/http"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+// MetaData 推流端通过@setDataFrame onMetaData发送的元数据
+type MetaData struct {
+	Duration        float64        `json:"duration,omitempty"`
+	FileSize        float64        `json:"filesize,omitempty"`
+	Width           float64        `json:"width,omitempty"`
+	Height          float64        `json:"height,omitempty"`
+	VideoCodecID    any            `json:"videocodecid,omitempty"` // 数字或者FourCC字符串
+	VideoDataRate   float64        `json:"videodatarate,omitempty"`
+	FrameRate       float64        `json:"framerate,omitempty"`
+	AudioCodecID    any            `json:"audiocodecid,omitempty"`
+	AudioDataRate   float64        `json:"audiodatarate,omitempty"`
+	AudioSampleRate float64        `json:"audiosamplerate,omitempty"`
+	AudioSampleSize float64        `json:"audiosamplesize,omitempty"`
+	AudioChannels   float64        `json:"audiochannels,omitempty"`
+	Stereo          bool           `json:"stereo,omitempty"`
+	Encoder         string         `json:"encoder,omitempty"`
+	Extra           map[string]any `json:"extra,omitempty"` // 其他自定义字段
+}
+
+// metaDataPublisher 保存了元数据的发布者，重新发布时随新的发布者一起替换
+type metaDataPublisher interface {
+	metaData() *MetaData
+}
+
+func (r *RTMPReceiver) metaData() *MetaData {
+	return r.metadata.Load()
+}
+
+// findMetaData 返回流当前的发布者的元数据
+func findMetaData(streamPath string) *MetaData {
+	if s := Streams.Get(streamPath); s != nil {
+		if p, ok := s.Publisher.(metaDataPublisher); ok {
+			return p.metaData()
+		}
+	}
+	return nil
+}
+
+func newMetaData(obj map[string]any) *MetaData {
+	m := &MetaData{Extra: make(map[string]any)}
+	for k, v := range obj {
+		n, _ := v.(float64)
+		switch k {
+		case "duration":
+			m.Duration = n
+		case "filesize":
+			m.FileSize = n
+		case "width":
+			m.Width = n
+		case "height":
+			m.Height = n
+		case "videocodecid":
+			m.VideoCodecID = v
+		case "videodatarate":
+			m.VideoDataRate = n
+		case "framerate":
+			m.FrameRate = n
+		case "audiocodecid":
+			m.AudioCodecID = v
+		case "audiodatarate":
+			m.AudioDataRate = n
+		case "audiosamplerate":
+			m.AudioSampleRate = n
+		case "audiosamplesize":
+			m.AudioSampleSize = n
+		case "audiochannels":
+			m.AudioChannels = n
+		case "stereo":
+			m.Stereo, _ = v.(bool)
+		case "encoder":
+			m.Encoder, _ = v.(string)
+		default:
+			m.Extra[k] = v
+		}
+	}
+	return m
+}
+
+// ToMap 转换为onMetaData的参数，未设置的字段不输出
+func (m *MetaData) ToMap() map[string]any {
+	obj := make(map[string]any, len(m.Extra)+16)
+	for k, v := range m.Extra {
+		obj[k] = v
+	}
+	set := func(k string, v float64) {
+		if v != 0 {
+			obj[k] = v
+		}
+	}
+	set("duration", m.Duration)
+	set("filesize", m.FileSize)
+	set("width", m.Width)
+	set("height", m.Height)
+	set("videodatarate", m.VideoDataRate)
+	set("framerate", m.FrameRate)
+	set("audiodatarate", m.AudioDataRate)
+	set("audiosamplerate", m.AudioSampleRate)
+	set("audiosamplesize", m.AudioSampleSize)
+	set("audiochannels", m.AudioChannels)
+	if m.VideoCodecID != nil {
+		obj["videocodecid"] = m.VideoCodecID
+	}
+	if m.AudioCodecID != nil {
+		obj["audiocodecid"] = m.AudioCodecID
+	}
+	if m.Stereo {
+		obj["stereo"] = true
+	}
+	if m.Encoder != "" {
+		obj["encoder"] = m.Encoder
+	}
+	return obj
+}
+
+// ReceiveData 处理推流端发送的数据消息，@setDataFrame onMetaData或者onMetaData保存为流的元数据，其他的转发给播放端
+func (r *RTMPReceiver) ReceiveData(msg *Chunk) {
+	data, ok := msg.MsgData.(*DataMessage)
+	if !ok || r.Stream == nil {
+		return
+	}
+	values, handler := data.Values, data.Handler
+	if handler == "@setDataFrame" && len(values) > 0 {
+		handler, _ = values[0].(string)
+		values = values[1:]
+	}
+	if handler != "onMetaData" {
+		// NetStream.send发送的其他数据消息转发给播放端
+		r.detectCaptionData(msg.ExtendTimestamp, handler, values)
+		r.relayData(msg.ExtendTimestamp, handler, values)
+		return
+	}
+	if len(values) == 0 {
+		return
+	}
+	if obj, ok := values[0].(map[string]any); ok {
+		r.metadata.Store(newMetaData(obj))
+		r.Info("metadata", zap.Any("onMetaData", obj))
+	}
+}
+
+// trackMetaData 根据轨道信息生成元数据，推流端发送过元数据时以其为基础，编码相关的字段以当前的序列头为准
+func (rtmp *RTMPSender) trackMetaData() *MetaData {
+	var m MetaData
+	if pm := findMetaData(rtmp.Stream.Path); pm != nil {
+		m = *pm
+	}
+	if a := rtmp.Audio; a != nil {
+		m.AudioCodecID = float64(a.CodecID)
+		m.AudioSampleRate = float64(a.SampleRate)
+		m.AudioSampleSize = float64(a.SampleSize)
+		m.AudioChannels = float64(a.Channels)
+		m.Stereo = a.Channels > 1
+		if m.AudioDataRate == 0 && a.BPS > 0 {
+			m.AudioDataRate = float64(a.BPS*8) / 1000
+		}
+	}
+	if v := rtmp.Video; v != nil {
+		m.VideoCodecID = float64(v.CodecID)
+		if rtmp.video.fourCC != "" {
+			// Enhanced RTMP中videocodecid为FourCC的数值
+			m.VideoCodecID = float64(binary.BigEndian.Uint32([]byte(rtmp.video.fourCC)))
+		}
+		m.Width = float64(v.SPSInfo.Width)
+		m.Height = float64(v.SPSInfo.Height)
+		if m.FrameRate == 0 && v.FPS > 0 {
+			m.FrameRate = float64(v.FPS)
+		}
+		if m.VideoDataRate == 0 && v.BPS > 0 {
+			m.VideoDataRate = float64(v.BPS*8) / 1000
+		}
+	}
+	return &m
+}
+
+// sendMetaData 在序列头之前发送流的元数据，序列头变化时重新发送
+func (rtmp *RTMPSender) sendMetaData() {
+	rtmp.metaSent.Store(true)
+	rtmp.SendMessage(RTMP_MSG_AMF0_METADATA, &DataMessage{"onMetaData", []any{rtmp.trackMetaData().ToMap()}, rtmp.StreamID})
+}
+
+func (*RTMPConfig) API_metadata(w http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	if m := findMetaData(streamPath); m != nil {
+		util.ReturnValue(m, w, r)
+	} else {
+		util.ReturnError(util.APIErrorNoStream, streamPath+" has no metadata", w, r)
+	}
+}
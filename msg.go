@@ -58,17 +58,21 @@ const (
 	// Chunk Stream ID == 1, (第三个byte) * 256 + 第二个byte + 64
 	// Chunk Stream ID == 2.
 	// 2 < Chunk Stream ID < 64(2的6次方)
-	RTMP_CSID_CONTROL = 0x02
-	RTMP_CSID_COMMAND = 0x03
-	RTMP_CSID_AUDIO   = 0x06
-	RTMP_CSID_DATA    = 0x05
-	RTMP_CSID_VIDEO   = 0x05
+	RTMP_CSID_CONTROL   = 0x02
+	RTMP_CSID_COMMAND   = 0x03
+	RTMP_CSID_AUDIO     = 0x06
+	RTMP_CSID_DATA      = 0x05
+	RTMP_CSID_VIDEO     = 0x05
+	RTMP_CSID_AGGREGATE = 0x07
 )
 
 func newChunkHeader(messageType byte) *ChunkHeader {
 	head := new(ChunkHeader)
 	head.ChunkStreamID = RTMP_CSID_CONTROL
-	if messageType == RTMP_MSG_AMF0_COMMAND {
+	switch messageType {
+	case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF0_METADATA, RTMP_MSG_AMF3_COMMAND, RTMP_MSG_AMF3_METADATA: // RTMP_CSID_DATA与视频共用，数据消息走命令通道
+		head.ChunkStreamID = RTMP_CSID_COMMAND
+	case RTMP_MSG_AMF0_SHARED, RTMP_MSG_AMF3_SHARED:
 		head.ChunkStreamID = RTMP_CSID_COMMAND
 	}
 	head.MessageTypeID = messageType
@@ -87,6 +91,12 @@ type HaveStreamID interface {
 }
 
 func GetRtmpMessage(chunk *Chunk, body util.Buffer) error {
+	return getRtmpMessage(chunk, body, true)
+}
+
+// getRtmpMessage createStream为true时TransactionId为2的响应解析为ResponseCreateStreamMessage，
+// 连接在没有等待createStream的响应时传入false，使其作为普通的响应交给Call
+func getRtmpMessage(chunk *Chunk, body util.Buffer, createStream bool) error {
 	switch chunk.MessageTypeID {
 	case RTMP_MSG_CHUNK_SIZE, RTMP_MSG_ABORT, RTMP_MSG_ACK, RTMP_MSG_ACK_SIZE:
 		if body.Len() < 4 {
@@ -152,24 +162,49 @@ func GetRtmpMessage(chunk *Chunk, body util.Buffer) error {
 	case RTMP_MSG_AUDIO: // RTMP消息类型ID=8, 音频数据.客户端或服务端发送本消息用于发送音频数据.
 	case RTMP_MSG_VIDEO: // RTMP消息类型ID=9, 视频数据.客户端或服务端发送本消息用于发送视频数据.
 	case RTMP_MSG_AMF3_METADATA: // RTMP消息类型ID=15, 数据消息.用AMF3编码.
+		decodeData(chunk, newAMFDecoder(skipAMF3Format(body)))
 	case RTMP_MSG_AMF3_SHARED: // RTMP消息类型ID=16, 共享对象消息.用AMF3编码.
+		return decodeSharedObject(chunk, skipAMF3Format(body))
 	case RTMP_MSG_AMF3_COMMAND: // RTMP消息类型ID=17, 命令消息.用AMF3编码.
-		decodeCommandAMF0(chunk, body[1:])
+		decodeCommand(chunk, newAMFDecoder(skipAMF3Format(body)), createStream)
 	case RTMP_MSG_AMF0_METADATA: // RTMP消息类型ID=18, 数据消息.用AMF0编码.
+		decodeData(chunk, &util.AMF{body})
 	case RTMP_MSG_AMF0_SHARED: // RTMP消息类型ID=19, 共享对象消息.用AMF0编码.
+		return decodeSharedObject(chunk, body)
 	case RTMP_MSG_AMF0_COMMAND: // RTMP消息类型ID=20, 命令消息.用AMF0编码.
-		decodeCommandAMF0(chunk, body) // 解析具体的命令消息
+		decodeCommand(chunk, &util.AMF{body}, createStream) // 解析具体的命令消息
 	case RTMP_MSG_AGGREGATE:
 	default:
 	}
 	return nil
 }
 
+// skipAMF3Format 类型15、17的消息体以一个值为0的格式字节开头，之后是AMF0编码的值
+func skipAMF3Format(body []byte) []byte {
+	if len(body) > 0 && body[0] == 0 {
+		return body[1:]
+	}
+	return body
+}
+
+// decodeData 解析数据消息，第一个值为处理函数名，例如@setDataFrame、onMetaData
+func decodeData(chunk *Chunk, amf amfReader) {
+	m := &DataMessage{Handler: amf.ReadShortString(), StreamID: chunk.MessageStreamID}
+	for amf.Len() > 0 {
+		v, err := amf.Unmarshal()
+		if err != nil {
+			break
+		}
+		m.Values = append(m.Values, v)
+	}
+	chunk.MsgData = m
+}
+
 // 03 00 00 00 00 01 02 14 00 00 00 00 02 00 07 63 6F 6E 6E 65 63 74 00 3F F0 00 00 00 00 00 00 08
 //
 // 这个函数解析的是从02(第13个字节)开始,前面12个字节是Header,后面的是Payload,即解析Payload.
 //
-// 解析用AMF0编码的命令消息.(Payload)
+// 解析命令消息.(Payload) 类型20用AMF0编码,类型17中的值遇到avmplus标记(0x11)时切换为AMF3编码.
 // 第一个字节(Byte)为此数据的类型.例如:string,int,bool...
 
 // string就是字符类型,一个byte的amf类型,两个bytes的字符长度,和N个bytes的数据.
@@ -183,15 +218,14 @@ func GetRtmpMessage(chunk *Chunk, body util.Buffer) error {
 
 // object类型要复杂点.
 // 第一个byte是03表示object,其后跟的是N个(key+value).最后以00 00 09表示object结束
-func decodeCommandAMF0(chunk *Chunk, body []byte) {
-	amf := util.AMF{body}        // rtmp_amf.go, amf 是 bytes类型, 将rtmp body(payload)放到bytes.Buffer(amf)中去.
+func decodeCommand(chunk *Chunk, amf amfReader, createStream bool) {
 	cmd := amf.ReadShortString() // rtmp_amf.go, 将payload的bytes类型转换成string类型.
 	cmdMsg := CommandMessage{
 		cmd,
 		uint64(amf.ReadNumber()),
 	}
 	switch cmd {
-	case "connect", "call":
+	case "connect":
 		chunk.MsgData = &CallMessage{
 			cmdMsg,
 			amf.ReadObject(),
@@ -232,14 +266,18 @@ func decodeCommandAMF0(chunk *Chunk, body []byte) {
 		chunk.MsgData = m
 	case "play2":
 		amf.Unmarshal()
-		chunk.MsgData = &Play2Message{
-			cmdMsg,
-			uint64(amf.ReadNumber()),
-			amf.ReadShortString(),
-			amf.ReadShortString(),
-			uint64(amf.ReadNumber()),
-			amf.ReadShortString(),
+		m := &Play2Message{CommandMessage: cmdMsg}
+		// 参数为NetStreamPlayOptions对象
+		if obj := amf.ReadObject(); obj != nil {
+			start, _ := obj["start"].(float64)
+			duration, _ := obj["len"].(float64)
+			m.StartTime = uint64(start)
+			m.Duration = uint64(duration)
+			m.OldStreamName, _ = obj["oldStreamName"].(string)
+			m.StreamName, _ = obj["streamName"].(string)
+			m.Transition, _ = obj["transition"].(string)
 		}
+		chunk.MsgData = m
 	case "publish":
 		amf.Unmarshal()
 		chunk.MsgData = &PublishMessage{
@@ -282,21 +320,22 @@ func decodeCommandAMF0(chunk *Chunk, body []byte) {
 			amf.ReadBool(),
 		}
 	case Response_Result, Response_Error, Response_OnStatus:
-		if cmdMsg.TransactionId == 2 {
+		if cmdMsg.TransactionId == 2 && createStream {
 			chunk.MsgData = &ResponseCreateStreamMessage{
 				cmdMsg, amf.ReadObject(), uint32(amf.ReadNumber()),
 			}
 			return
 		}
-		response := &ResponseMessage{
-			cmdMsg,
-			amf.ReadObject(),
-			amf.ReadObject(), "",
-		}
+		properties, _ := amf.Unmarshal()
+		result, _ := amf.Unmarshal()
+		response := &ResponseMessage{CommandMessage: cmdMsg, Result: result}
+		response.Properties, _ = properties.(map[string]any)
+		response.Infomation, _ = result.(map[string]any)
 		if response.Infomation == nil && response.Properties != nil {
 			response.Infomation = response.Properties
 		}
-		codef := zap.String("code", response.Infomation["code"].(string))
+		code, _ := response.Infomation["code"].(string)
+		codef := zap.String("code", code)
 		switch response.Infomation["level"] {
 		case Level_Status:
 			RTMPPlugin.Info("_result :", codef)
@@ -305,14 +344,14 @@ func decodeCommandAMF0(chunk *Chunk, body []byte) {
 		case Level_Error:
 			RTMPPlugin.Error("_result :", codef)
 		}
-		if strings.HasPrefix(response.Infomation["code"].(string), "NetStream.Publish") {
+		if strings.HasPrefix(code, "NetStream.Publish") {
 			chunk.MsgData = &ResponsePublishMessage{
 				cmdMsg,
 				response.Properties,
 				response.Infomation,
 				chunk.MessageStreamID,
 			}
-		} else if strings.HasPrefix(response.Infomation["code"].(string), "NetStream.Play") {
+		} else if strings.HasPrefix(code, "NetStream.Play") {
 			chunk.MsgData = &ResponsePlayMessage{
 				cmdMsg,
 				response.Infomation,
@@ -321,11 +360,21 @@ func decodeCommandAMF0(chunk *Chunk, body []byte) {
 		} else {
 			chunk.MsgData = response
 		}
-	case "FCPublish", "FCUnpublish":
-		fallthrough
-	default:
+	case "FCPublish", "FCUnpublish", "FCSubscribe", "FCUnsubscribe":
 		chunk.MsgData = &struct{ CommandMessage }{cmdMsg}
 		RTMPPlugin.Info("decode command amf0 ", zap.String("cmd", cmd))
+	default:
+		// 其他命令为NetConnection.call调用的方法
+		m := &RPCMessage{CommandMessage: cmdMsg}
+		m.Object, _ = amf.Unmarshal()
+		for amf.Len() > 0 {
+			v, err := amf.Unmarshal()
+			if err != nil {
+				break
+			}
+			m.Args = append(m.Args, v)
+		}
+		chunk.MsgData = m
 	}
 }
 
@@ -389,6 +438,21 @@ type MetadataMessage struct {
 	Proterties map[string]interface{} `json:",omitempty"`
 }
 
+// DataMessage 由处理函数名和参数组成的数据消息，例如onPlayStatus
+type DataMessage struct {
+	Handler  string
+	Values   []any
+	StreamID uint32
+}
+
+func (msg *DataMessage) GetStreamID() uint32 {
+	return msg.StreamID
+}
+
+func (msg *DataMessage) Encode(buf util.IAMF) {
+	buf.Marshals(append([]any{msg.Handler}, msg.Values...)...)
+}
+
 // Object 可选值:
 // App 				客户端要连接到的服务应用名 												Testapp
 // Flashver			Flash播放器版本.和应用文档中getversion()函数返回的字符串相同.			FMSc/1.0
@@ -729,6 +793,7 @@ type ResponseMessage struct {
 	Properties  map[string]any `json:",omitempty"`
 	Infomation  map[string]any `json:",omitempty"`
 	Description string
+	Result      any `json:",omitempty"` // 第二个参数，调用客户端方法时为返回值
 }
 
 // User Control Message 4.
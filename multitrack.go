@@ -0,0 +1,261 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// RTMP_CSID_MULTITRACK 附加轨道从该chunk stream id开始依次使用
+const RTMP_CSID_MULTITRACK = 0x08
+
+type trackPacket struct {
+	fourCC  string
+	trackID byte
+	data    []byte
+}
+
+// splitMultitrack 拆分Multitrack包，data从AvMultitrackType开始
+func splitMultitrack(data []byte) (packetType byte, tracks []trackPacket, err error) {
+	errShort := errors.New("multitrack packet truncated")
+	if len(data) < 1 {
+		return 0, nil, errShort
+	}
+	multitrackType, packetType := data[0]>>4, data[0]&0x0F
+	data = data[1:]
+	var fourCC string
+	if multitrackType != AvMultitrackTypeManyTracksManyCodecs {
+		if len(data) < 4 {
+			return 0, nil, errShort
+		}
+		fourCC, data = string(data[:4]), data[4:]
+	}
+	for len(data) > 0 {
+		t := trackPacket{fourCC: fourCC}
+		if multitrackType == AvMultitrackTypeManyTracksManyCodecs {
+			if len(data) < 4 {
+				return 0, nil, errShort
+			}
+			t.fourCC, data = string(data[:4]), data[4:]
+		}
+		if len(data) < 1 {
+			return 0, nil, errShort
+		}
+		t.trackID, data = data[0], data[1:]
+		if multitrackType == AvMultitrackTypeOneTrack {
+			t.data, data = data, nil
+		} else {
+			if len(data) < 3 {
+				return 0, nil, errShort
+			}
+			var size uint32
+			util.GetBE(data[:3], &size)
+			if data = data[3:]; len(data) < int(size) {
+				return 0, nil, errShort
+			}
+			t.data, data = data[:size], data[size:]
+		}
+		tracks = append(tracks, t)
+	}
+	return
+}
+
+// receiveMultitrack 把Multitrack包中的每个轨道转换为旧格式后写入，trackId为0的写入主轨道
+func (r *RTMPReceiver) receiveMultitrack(ts uint32, data []byte, video bool) {
+	frameType := data[0] >> 4 & 0b0111
+	packetType, tracks, err := splitMultitrack(data[1:])
+	if err != nil {
+		r.Warn("multitrack", zap.Error(err))
+		return
+	}
+	for _, t := range tracks {
+		var head, payload []byte
+		var ok bool
+		if video {
+			head, payload, ok = r.legacyVideoTag(frameType, packetType, t.fourCC, t.data)
+		} else {
+			head, payload, ok = r.legacyAudioTag(packetType, t.fourCC, t.data)
+		}
+		if !ok {
+			continue
+		}
+		tag := r.newTag(head, payload)
+		switch {
+		case t.trackID != 0:
+			if at := r.extraTrack(t.trackID, video, head); at != nil {
+				at.WriteAVCC(ts, &tag)
+			} else {
+				tag.Recycle()
+			}
+		case video && r.VideoTrack == nil:
+			r.WriteAVCCVideo(0, &tag, r.bytePool)
+		case video:
+			r.VideoTrack.WriteAVCC(ts, &tag)
+		default:
+			r.writeAudio(ts, &tag)
+		}
+	}
+}
+
+// extraTrack 获取或者创建附加轨道，命名为audio+trackId、video+trackId，需要从序列头开始创建
+func (r *RTMPReceiver) extraTrack(id byte, video bool, head []byte) (at common.AVTrack) {
+	tracks := &r.audioTracks
+	if video {
+		tracks = &r.videoTracks
+	}
+	if at = (*tracks)[id]; at != nil {
+		return
+	}
+	if len(head) < 2 || head[1] != 0 {
+		r.Warn("need sequence frame", zap.Uint8("trackId", id))
+		return nil
+	}
+	if video {
+		name := fmt.Sprintf("video%d", id)
+		switch codec.VideoCodecID(head[0] & 0x0F) {
+		case codec.CodecID_H264:
+			at = track.NewH264(r, r.bytePool, name)
+		case codec.CodecID_H265:
+			at = track.NewH265(r, r.bytePool, name)
+		case codec.CodecID_AV1:
+			at = track.NewAV1(r, r.bytePool, name)
+		}
+	} else {
+		name := fmt.Sprintf("audio%d", id)
+		switch codec.AudioCodecID(head[0] >> 4) {
+		case codec.CodecID_AAC:
+			at = track.NewAAC(r, r.bytePool, name)
+		case codec.CodecID_OPUS:
+			at = track.NewOpus(r, r.bytePool, name)
+		}
+	}
+	if at == nil {
+		r.Warn("unsupported multitrack codec", zap.Uint8("trackId", id))
+		return nil
+	}
+	if *tracks == nil {
+		*tracks = make(map[byte]common.AVTrack)
+	}
+	(*tracks)[id] = at
+	return
+}
+
+// trackSender 订阅流的一个附加轨道，以OneTrack的Multitrack包发送给播放端，时间轴跟随主订阅者
+type trackSender struct {
+	Subscriber
+	av     AVSender
+	parent *RTMPSender
+}
+
+func (t *trackSender) OnEvent(event any) {
+	switch v := event.(type) {
+	case AudioDeConf:
+		if t.av.fourCC = audioFourCC(t.Audio.CodecID); t.av.fourCC == "" || !t.parent.caps.Support(t.av.fourCC, false) {
+			t.Stop(zap.String("reason", "unsupported multitrack audio codec"))
+			return
+		}
+		t.av.sendSequenceHead(v)
+	case VideoDeConf:
+		if t.av.fourCC = videoFourCC(t.Video.CodecID); t.av.fourCC == "" || !t.parent.caps.Support(t.av.fourCC, true) {
+			t.Stop(zap.String("reason", "unsupported multitrack video codec"))
+			return
+		}
+		t.av.sendSequenceHead(v)
+	case AudioFrame:
+		t.sendFrame(v.AVFrame)
+	case VideoFrame:
+		t.sendFrame(v.AVFrame)
+	default:
+		t.Subscriber.OnEvent(event)
+	}
+}
+
+func (t *trackSender) sendFrame(frame *common.AVFrame) {
+	p := t.parent
+	started, _ := p.clock.position()
+	if !started || p.paused.Load() || p.timeshifting.Load() || p.resuming.Load() || t.av.muted.Load() {
+		// 之后发送的第一帧使用绝对时间戳
+		t.av.firstSent.Store(false)
+		return
+	}
+	if err := t.av.sendFrame(frame, uint32(frame.Timestamp/time.Millisecond)-p.clock.offset()); err != nil {
+		t.Stop(zap.Error(err))
+	}
+}
+
+func audioFourCC(codecID codec.AudioCodecID) string {
+	switch codecID {
+	case codec.CodecID_AAC:
+		return FourCC_AAC
+	case codec.CodecID_OPUS:
+		return FourCC_Opus
+	}
+	return ""
+}
+
+func videoFourCC(codecID codec.VideoCodecID) string {
+	switch codecID {
+	case codec.CodecID_H264:
+		return FourCC_AVC
+	case codec.CodecID_H265:
+		return FourCC_HEVC
+	case codec.CodecID_AV1:
+		return FourCC_AV1
+	}
+	return ""
+}
+
+// subscribeTracks 按照播放参数audioTracks、videoTracks订阅附加轨道，例如audioTracks=1,2订阅audio1和audio2。
+// 客户端需要在connect的capsEx中声明支持Multitrack
+func (s *RTMPSubscriber) subscribeTracks(ctx context.Context, c *config.Subscribe) {
+	if s.streamInfo.Get("audioTracks") == "" && s.streamInfo.Get("videoTracks") == "" {
+		return
+	}
+	if s.caps.CapsEx&CapsExMultitrack == 0 {
+		s.Warn("client does not support multitrack", zap.Int("capsEx", s.caps.CapsEx))
+		return
+	}
+	csid := uint32(RTMP_CSID_MULTITRACK)
+	for _, video := range []bool{false, true} {
+		key, prefix, argName, typeID := "audioTracks", "audio", c.SubAudioArgName, byte(RTMP_MSG_AUDIO)
+		if video {
+			key, prefix, argName, typeID = "videoTracks", "video", c.SubVideoArgName, RTMP_MSG_VIDEO
+		}
+		for _, id := range strings.Split(s.streamInfo.Get(key), ",") {
+			n, err := strconv.ParseUint(id, 10, 8)
+			if err != nil || n == 0 || csid > 63 {
+				continue
+			}
+			t := &trackSender{parent: &s.RTMPSender}
+			t.av.RTMPSender = &s.RTMPSender
+			t.av.ChunkStreamID = csid
+			t.av.MessageTypeID = typeID
+			t.av.MessageStreamID = s.StreamID
+			t.av.multitrack = true
+			t.av.trackID = byte(n)
+			cfg := *c
+			cfg.SubAudio, cfg.SubVideo = !video, video
+			t.Config = &cfg
+			t.ID = s.ID + "|" + prefix + id
+			t.SetParentCtx(ctx)
+			if err = RTMPPlugin.Subscribe(s.Stream.Path+"?"+argName+"="+prefix+id, t); err != nil {
+				s.Warn("subscribe track", zap.String("track", prefix+id), zap.Error(err))
+				continue
+			}
+			csid++
+			s.tracks = append(s.tracks, t)
+			go t.PlayRaw()
+		}
+	}
+}
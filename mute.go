@@ -0,0 +1,36 @@
+package rtmp
+
+// SetReceive 处理receiveAudio/receiveVideo，关闭后不再发送该轨道
+func (av *AVSender) SetReceive(on bool) {
+	if !on {
+		av.muted.Store(true)
+	} else if av.muted.Load() {
+		av.unmuting.Store(true)
+		av.muted.Store(false)
+	}
+}
+
+// receiving 在发送帧的协程中调用，关闭接收时丢弃帧。
+// 重新开启后视频等待关键帧，并在第一帧之前重新发送序列头
+func (av *AVSender) receiving(iframe bool) bool {
+	if av.muted.Load() {
+		return false
+	}
+	if av.unmuting.Load() {
+		if av.MessageTypeID == RTMP_MSG_VIDEO && !iframe {
+			return false
+		}
+		// 时移协程和发送帧的协程可能同时调用，只重新发送一次
+		if av.unmuting.CompareAndSwap(true, false) {
+			av.firstSent.Store(false)
+			switch seqHead := av.lastSequenceHead(); {
+			case seqHead == nil:
+			case av.MessageTypeID == RTMP_MSG_VIDEO:
+				av.sendSequenceHeads(nil, seqHead)
+			default:
+				av.sendSequenceHeads(seqHead, nil)
+			}
+		}
+	}
+	return true
+}
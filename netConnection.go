@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"runtime"
+	"sync"
 	"sync/atomic"
 
 	"go.uber.org/zap"
@@ -58,10 +59,21 @@ type NetConnection struct {
 	incommingChunks map[uint32]*Chunk
 	objectEncoding  float64
 	appName         string
-	tmpBuf          util.Buffer //用来接收/发送小数据，复用内存
+	appPath         string       // 带vhost前缀的应用路径，connect成功后设置
+	connectInfo     *ConnectInfo // 只在第一次connect时设置，之后处理方法调用的协程可以直接读取
+	tmpBuf          util.Buffer  //用来接收/发送小数据，复用内存
 	chunkHeader     util.Buffer
 	bytePool        util.BytesPool
-	writing         atomic.Bool // false 可写，true 不可写
+	writing         atomic.Bool                      // false 可写，true 不可写
+	aggregated      []*Chunk                         // 聚合消息拆分出的还未返回的子消息
+	caps            Capabilities                     // 对端声明的Enhanced RTMP能力
+	sharedObjects   map[string]*SharedObject         // 使用中的远程共享对象
+	calls           map[uint64]chan *ResponseMessage // 调用客户端的方法后等待回复
+	callID          uint64
+	creatingStream  atomic.Bool // 已发送createStream，等待TransactionId为2的响应
+	callLock        sync.Mutex
+	rpcSlots        chan struct{} // 正在执行的客户端调用，限制并发数
+	checkingBW      atomic.Bool   // 正在进行带宽检测
 }
 
 func NewNetConnection(conn net.Conn) *NetConnection {
@@ -75,6 +87,7 @@ func NewNetConnection(conn net.Conn) *NetConnection {
 		tmpBuf:          make(util.Buffer, 4),
 		chunkHeader:     make(util.Buffer, 0, 16),
 		bytePool:        make(util.BytesPool, 17),
+		rpcSlots:        make(chan struct{}, maxConcurrentRPC),
 	}
 }
 func (conn *NetConnection) ReadFull(buf []byte) (n int, err error) {
@@ -99,6 +112,36 @@ func (conn *NetConnection) ResponseCreateStream(tid uint64, streamID uint32) err
 	return conn.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
 }
 
+// RejectConnect 以_error响应connect，随后应关闭连接
+func (conn *NetConnection) RejectConnect(tid uint64, code, description string) error {
+	m := new(ResponseConnectMessage)
+	m.CommandName = Response_Error
+	m.TransactionId = tid
+	m.Infomation = map[string]any{
+		"level":       Level_Error,
+		"code":        code,
+		"description": description,
+	}
+	return conn.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
+}
+
+// RedirectConnect 按照FMS的方式通知客户端重定向到location
+func (conn *NetConnection) RedirectConnect(tid uint64, location string) error {
+	m := new(ResponseConnectMessage)
+	m.CommandName = Response_Error
+	m.TransactionId = tid
+	m.Infomation = map[string]any{
+		"level":       Level_Error,
+		"code":        NetConnection_Connect_Rejected,
+		"description": "redirect to " + location,
+		"ex": map[string]any{
+			"code":     302,
+			"redirect": location,
+		},
+	}
+	return conn.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
+}
+
 // func (conn *NetConnection) SendCommand(message string, args any) error {
 // 	switch message {
 // 	// case SEND_SET_BUFFER_LENGTH_MESSAGE:
@@ -159,9 +202,9 @@ func (conn *NetConnection) readChunk() (msg *Chunk, err error) {
 		chunk.ChunkHeader.ExtendTimestamp += chunk.ChunkHeader.Timestamp
 		msg = chunk
 		switch chunk.MessageTypeID {
-		case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
+		case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO, RTMP_MSG_AGGREGATE:
 		default:
-			err = GetRtmpMessage(msg, msg.AVData.ToBytes())
+			err = conn.decodeMessage(msg, msg.AVData.ToBytes())
 			msg.AVData.Recycle()
 		}
 		conn.incommingChunks[ChunkStreamID] = &Chunk{
@@ -256,8 +299,15 @@ func (conn *NetConnection) RecvMessage() (msg *Chunk, err error) {
 		err = conn.SendMessage(RTMP_MSG_ACK, Uint32Message(conn.totalRead))
 	}
 	for msg == nil && err == nil {
+		if len(conn.aggregated) > 0 {
+			msg, conn.aggregated = conn.aggregated[0], conn.aggregated[1:]
+			return
+		}
 		if msg, err = conn.readChunk(); msg != nil && err == nil {
 			switch msg.MessageTypeID {
+			case RTMP_MSG_AGGREGATE:
+				conn.aggregated, err = conn.splitAggregate(msg)
+				msg = nil
 			case RTMP_MSG_CHUNK_SIZE:
 				conn.readChunkSize = int(msg.MsgData.(Uint32Message))
 				RTMPPlugin.Info("msg read chunk size", zap.Int("readChunkSize", conn.readChunkSize))
@@ -272,7 +322,7 @@ func (conn *NetConnection) RecvMessage() (msg *Chunk, err error) {
 				conn.bandwidth = uint32(msg.MsgData.(Uint32Message))
 			case RTMP_MSG_BANDWIDTH:
 				conn.bandwidth = msg.MsgData.(*SetPeerBandwidthMessage).AcknowledgementWindowsize
-			case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
+			case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF3_COMMAND, RTMP_MSG_AMF0_METADATA, RTMP_MSG_AMF3_METADATA, RTMP_MSG_AMF0_SHARED, RTMP_MSG_AMF3_SHARED, RTMP_MSG_AUDIO, RTMP_MSG_VIDEO:
 				return msg, err
 			}
 		}
@@ -298,8 +348,9 @@ func (conn *NetConnection) SendMessage(t byte, msg RtmpMessage) (err error) {
 	if conn.objectEncoding == 0 {
 		msg.Encode(&amf)
 	} else {
-		amf := util.AMF3{AMF: amf}
-		msg.Encode(&amf)
+		amf3 := avmplusAMF{AMF: amf}
+		msg.Encode(&amf3)
+		amf = amf3.AMF
 	}
 	conn.tmpBuf = amf.Buffer
 	head := newChunkHeader(t)
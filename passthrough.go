@@ -0,0 +1,166 @@
+package rtmp
+
+import (
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+)
+
+// 引擎中没有对应轨道的编码不写入引擎，推流端发送的Enhanced RTMP标签原样放入每个播放端和转推的原样转发队列，
+// 由单独的协程在收到时转发给声明支持该编码的rtmp播放端和转推，不等待引擎中的音视频帧，流中可以只有这些编码。
+// SequenceStart保存在发布者上，播放端在第一帧之前先收到它
+
+// passthroughFourCCs 原样转发的编码
+var passthroughFourCCs = map[string]bool{
+	FourCC_VP9:  true,
+	FourCC_FLAC: true,
+	FourCC_AC3:  true,
+	FourCC_EAC3: true,
+}
+
+func isPassthrough(fourCC string) bool {
+	return passthroughFourCCs[fourCC]
+}
+
+// maxPassQueue 播放端等待发送的原样转发标签的上限，超过时丢弃最早的
+const maxPassQueue = 256
+
+// auxConfigKey 附加配置在发布者上保存的键，视频为MPEG2TSSequenceStart，音频为MultichannelConfig，
+// 随该编码的序列头一起发送
+func auxConfigKey(fourCC string) string {
+	return fourCC + "/aux"
+}
+
+// isAuxConfig 标签是否为附加配置
+func isAuxConfig(tag []byte, video bool) bool {
+	if video {
+		return tag[0]&0x0F == PacketTypeMPEG2TSSequenceStart
+	}
+	return tag[0]&0x0F == AudioPacketTypeMultichannelConfig
+}
+
+// passthroughPublisher 保存了原样转发的编码的配置的发布者
+type passthroughPublisher interface {
+	passthroughConfig(key string) []byte
+}
+
+func (r *RTMPReceiver) passthroughConfig(key string) []byte {
+	if v, ok := r.passConfigs.Load(key); ok {
+		return v.([]byte)
+	}
+	return nil
+}
+
+// findPassthroughConfig 返回流当前的发布者保存的配置标签
+func findPassthroughConfig(streamPath, key string) []byte {
+	if s := Streams.Get(streamPath); s != nil {
+		if p, ok := s.Publisher.(passthroughPublisher); ok {
+			return p.passthroughConfig(key)
+		}
+	}
+	return nil
+}
+
+// passthrough 转发不写入引擎的标签，data在之后会被回收，需要复制。
+// SequenceStart和附加配置同时保存下来，之后的播放端在第一帧之前先收到它们
+func (r *RTMPReceiver) passthrough(ts uint32, fourCC string, packetType byte, data []byte, video bool) {
+	if r.Stream == nil {
+		return
+	}
+	tag := append([]byte(nil), data...)
+	if isAuxConfig(tag, video) {
+		r.Debug("passthrough aux config", zap.String("fourcc", fourCC), zap.Int("size", len(data)-5))
+		r.passConfigs.Store(auxConfigKey(fourCC), tag)
+		if video {
+			// MPEG2TSSequenceStart只随序列头发送
+			return
+		}
+	} else if packetType == PacketTypeSequenceStart {
+		r.Info("passthrough sequence start", zap.String("fourcc", fourCC), zap.Int("configSize", len(data)-5))
+		r.passConfigs.Store(fourCC, tag)
+	}
+	relayDataFrame(r.Stream.Path, dataFrame{ts: ts, tag: tag, fourCC: fourCC, video: video})
+}
+
+// keyFrame 音频标签和视频关键帧可以作为恢复直播后的第一帧
+func (f *dataFrame) keyFrame() bool {
+	return !f.video || f.tag[0]>>4&0b0111 == 1
+}
+
+// queuePassthrough 需要持有dataRelay的锁，第一次收到时创建队列并启动发送协程
+func (rtmp *RTMPSender) queuePassthrough(f dataFrame) {
+	if rtmp.passQueue == nil {
+		rtmp.passQueue = make(chan dataFrame, maxPassQueue)
+		go rtmp.sendPassthroughs(rtmp.passQueue)
+	}
+	for {
+		select {
+		case rtmp.passQueue <- f:
+			return
+		default:
+			// 播放端发送太慢，丢弃最早的
+			select {
+			case <-rtmp.passQueue:
+			default:
+			}
+		}
+	}
+}
+
+// sendPassthroughs 按收到的顺序发送原样转发的标签，离开dataRelay时队列关闭
+func (rtmp *RTMPSender) sendPassthroughs(queue chan dataFrame) {
+	for f := range queue {
+		ts, ok := rtmp.canSendPassthrough(&f)
+		if !ok {
+			continue
+		}
+		// 先发送已合并的帧，客户端按收到的顺序处理
+		rtmp.aggregate.flush()
+		if err := rtmp.sendPassthrough(&f, ts); err != nil {
+			rtmp.Stop(zap.Error(err))
+			return
+		}
+		rtmp.checkDuration()
+	}
+}
+
+// sendPassthrough 以客户端时间轴上的时间戳ts发送，播放端没有声明支持该编码时丢弃，第一帧之前先发送保存的SequenceStart
+func (rtmp *RTMPSender) sendPassthrough(f *dataFrame, ts uint32) error {
+	av := &rtmp.audio
+	if f.video {
+		av = &rtmp.video
+	}
+	if av.muted.Load() || !rtmp.caps.Support(f.fourCC, f.video) {
+		return nil
+	}
+	if rtmp.passSent == nil {
+		rtmp.passSent = make(map[string]bool)
+	}
+	var tags [][]byte
+	isConfig := f.tag[0]&0x0F == PacketTypeSequenceStart
+	if isAuxConfig(f.tag, f.video) && !rtmp.passSent[f.fourCC] {
+		// 还没有发送SequenceStart，之后随它一起发送
+		return nil
+	}
+	if isConfig {
+		tags = append(tags, f.tag)
+	} else if !rtmp.passSent[f.fourCC] {
+		if config := findPassthroughConfig(rtmp.Stream.Path, f.fourCC); config != nil {
+			tags = append(tags, config)
+		}
+	}
+	if len(tags) > 0 {
+		rtmp.passSent[f.fourCC] = true
+		if tag := findPassthroughConfig(rtmp.Stream.Path, auxConfigKey(f.fourCC)); tag != nil {
+			tags = append(tags, tag)
+		}
+	}
+	if !isConfig {
+		tags = append(tags, f.tag)
+	}
+	for _, tag := range tags {
+		if err := av.sendTag(tag, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
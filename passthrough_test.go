@@ -0,0 +1,107 @@
+package rtmp
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	engine "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+// newPassthroughPublisher 创建推流到streamPath的发布者，只调用转换Enhanced RTMP标签的部分
+func newPassthroughPublisher(streamPath string) *RTMPReceiver {
+	r := &RTMPReceiver{}
+	r.Logger = zap.NewNop()
+	r.Stream = &engine.Stream{Path: streamPath}
+	return r
+}
+
+// publishTag 以推流端的方式接收一个Enhanced RTMP标签
+func (r *RTMPReceiver) publishTag(typeID byte, ts uint32, tag []byte) {
+	msg := &Chunk{ChunkHeader: ChunkHeader{MessageTypeID: typeID, ExtendTimestamp: ts}}
+	msg.AVData.Push(&util.ListItem[util.Buffer]{Value: append([]byte(nil), tag...)})
+	if typeID == RTMP_MSG_VIDEO {
+		r.exVideoToLegacy(msg)
+	} else {
+		r.exAudioToLegacy(msg)
+	}
+}
+
+// waitTags 等待播放端收到n个标签
+func waitTags(t *testing.T, c *lockedConn, n int) (tags []aggTag) {
+	t.Helper()
+	waitFor(t, func() bool {
+		tags, _ = receivedTags(t, c.Bytes())
+		return len(tags) >= n
+	})
+	return
+}
+
+// 流中只有VP9和FLAC时，标签在收到时发送给声明支持的播放端，时间轴从第一个标签开始
+func TestPassthroughOnly(t *testing.T) {
+	r := newPassthroughPublisher("live/vp9flac")
+	sender, c := newTestSender(t, "live/vp9flac")
+	sender.caps = Capabilities{FourCcList: []string{FourCC_VP9, FourCC_FLAC}}
+	legacy, cl := newTestSender(t, "live/vp9flac")
+
+	vp9Seq := append([]byte{0x90}, "vp09\x01\x02"...)
+	flacSeq := append([]byte{0x90}, "fLaC\x66\x4C"...)
+	vp9Key := append([]byte{0x91}, "vp09\xAA"...)
+	flacFrame := append([]byte{0x91}, "fLaC\xBB"...)
+	vp9Inter := append([]byte{0xA1}, "vp09\xCC"...)
+	published := []aggTag{
+		{RTMP_MSG_VIDEO, 1000, vp9Seq},
+		{RTMP_MSG_AUDIO, 1000, flacSeq},
+		{RTMP_MSG_VIDEO, 1000, vp9Key},
+		{RTMP_MSG_AUDIO, 1010, flacFrame},
+		{RTMP_MSG_VIDEO, 1033, vp9Inter},
+	}
+	for _, tag := range published {
+		r.publishTag(tag.typeID, tag.ts, tag.data)
+	}
+	want := make([]aggTag, len(published))
+	for i, tag := range published {
+		want[i] = aggTag{tag.typeID, tag.ts - 1000, tag.data}
+	}
+	checkTags(t, waitTags(t, c, len(want)), want)
+
+	// 暂停时丢弃，恢复直播后从视频关键帧开始，时间戳与暂停前连续
+	sender.Pause()
+	r.publishTag(RTMP_MSG_VIDEO, 2000, vp9Inter)
+	sender.Unpause()
+	r.publishTag(RTMP_MSG_VIDEO, 2033, vp9Inter)
+	r.publishTag(RTMP_MSG_VIDEO, 2066, vp9Key)
+	r.publishTag(RTMP_MSG_AUDIO, 2076, flacFrame)
+	want = append(want, aggTag{RTMP_MSG_VIDEO, 33, vp9Key}, aggTag{RTMP_MSG_AUDIO, 43, flacFrame})
+	checkTags(t, waitTags(t, c, len(want)), want)
+	if played := sender.clock.playedTime(); played != 43 {
+		t.Errorf("played %d", played)
+	}
+
+	// 没有声明支持这些编码的播放端收不到
+	legacy.leaveDataRelay()
+	if tags, _ := receivedTags(t, cl.Bytes()); len(tags) != 0 {
+		t.Errorf("legacy client received %d tags", len(tags))
+	}
+}
+
+// 离开dataRelay后原样转发队列关闭，之后的标签不再放入
+func TestPassthroughLeave(t *testing.T) {
+	r := newPassthroughPublisher("live/flac")
+	sender, c := newTestSender(t, "live/flac")
+	sender.caps = Capabilities{FourCcList: []string{FourCC_FLAC}}
+	flacFrame := append([]byte{0x91}, "fLaC\xBB"...)
+	r.publishTag(RTMP_MSG_AUDIO, 0, flacFrame)
+	waitTags(t, c, 1)
+	sender.leaveDataRelay()
+	if sender.passQueue != nil {
+		t.Fatal("queue not closed")
+	}
+	if _, ok := dataRelays.Load("live/flac"); ok {
+		t.Fatal("relay not removed")
+	}
+	r.publishTag(RTMP_MSG_AUDIO, 10, flacFrame)
+	if tags, _ := receivedTags(t, c.Bytes()); len(tags) != 1 {
+		t.Errorf("%d tags after leaving", len(tags))
+	}
+}
@@ -0,0 +1,156 @@
+package rtmp
+
+import (
+	"sync"
+	"time"
+
+	"m7s.live/engine/v4/common"
+)
+
+// playClock 客户端时间轴的状态，发送帧的协程、时移协程和处理命令的协程都会访问
+type playClock struct {
+	sync.Mutex
+	started    bool
+	lastTS     uint32 // 最后发送的帧在流中的时间戳
+	timeOffset uint32 // 流时间戳与客户端时间戳的差值
+	played     uint32 // 已播放的媒体时长，毫秒
+	counting   bool   // 为false时下一帧作为计算played的起点，seek、恢复播放后置为false
+	detached   bool   // 已经交给play2切换后的订阅者，不再修改
+	engine     bool   // 发送过引擎中的帧，之后由它们恢复直播和计算played，原样转发的标签只跟随时间轴
+}
+
+// detach play2切换时调用，之后发送帧的协程和时移协程都不再修改时间轴，返回最终的状态
+func (c *playClock) detach() (started bool, lastTS uint32, timeOffset uint32, played uint32) {
+	c.Lock()
+	defer c.Unlock()
+	c.detached = true
+	return c.started, c.lastTS, c.timeOffset, c.played
+}
+
+// advance 记录发送了流时间戳为ts的帧并累计播放的媒体时长，调用前需要加锁
+func (c *playClock) advance(ts uint32) {
+	if c.detached {
+		return
+	}
+	if c.counting && int32(ts-c.lastTS) > 0 {
+		c.played += ts - c.lastTS
+	}
+	c.counting = true
+	c.lastTS = ts
+}
+
+func (c *playClock) playedTime() uint32 {
+	c.Lock()
+	defer c.Unlock()
+	return c.played
+}
+
+// offset 返回流时间戳与客户端时间戳的差值
+func (c *playClock) offset() uint32 {
+	c.Lock()
+	defer c.Unlock()
+	return c.timeOffset
+}
+
+// position 返回是否已经开始播放以及最后发送的帧在流中的时间戳
+func (c *playClock) position() (started bool, lastTS uint32) {
+	c.Lock()
+	defer c.Unlock()
+	return c.started, c.lastTS
+}
+
+// Pause 暂停后丢弃所有音视频帧
+func (rtmp *RTMPSender) Pause() {
+	rtmp.paused.Store(true)
+}
+
+// Unpause 有时移缓冲时从暂停的位置恢复播放，否则从直播的最新位置恢复，有视频时从关键帧开始
+func (rtmp *RTMPSender) Unpause() {
+	rtmp.paused.Store(false)
+	if dvr := findDVR(rtmp.Stream.Path); dvr != nil {
+		started, lastTS := rtmp.clock.position()
+		if first, _, ok := dvr.Range(); ok && started && lastTS >= first {
+			rtmp.timeshift(dvr, lastTS, true)
+			return
+		}
+	}
+	rtmp.GoLive()
+}
+
+func (rtmp *RTMPSender) IsPaused() bool {
+	return rtmp.paused.Load()
+}
+
+// canSend 在发送帧的协程中调用，返回客户端时间轴上的时间戳。
+// 恢复直播时把中间跳过的时间计入timeOffset，使客户端收到的时间戳保持连续
+func (rtmp *RTMPSender) canSend(frame *common.AVFrame, absTime uint32, isVideo bool) (uint32, bool) {
+	ts := uint32(frame.Timestamp / time.Millisecond)
+	clock := &rtmp.clock
+	clock.Lock()
+	defer clock.Unlock()
+	if clock.detached {
+		return 0, false
+	}
+	if !clock.started {
+		clock.started = true
+		clock.timeOffset = ts - absTime
+	}
+	clock.engine = true
+	if rtmp.paused.Load() || rtmp.timeshifting.Load() {
+		return 0, false
+	}
+	if rtmp.resuming.Load() {
+		if rtmp.video.seqHeadSent.Load() && !(isVideo && frame.IFrame) {
+			return 0, false
+		}
+		rtmp.resuming.Store(false)
+		if ts > clock.lastTS {
+			clock.timeOffset += ts - clock.lastTS
+		}
+		clock.counting = false
+		// 恢复后的第一帧使用绝对时间戳
+		rtmp.audio.firstSent.Store(false)
+		rtmp.video.firstSent.Store(false)
+	}
+	clock.advance(ts)
+	return ts - clock.timeOffset, true
+}
+
+// canSendPassthrough 在发送原样转发标签的协程中调用，返回客户端时间轴上的时间戳。
+// 流中只有原样转发的编码时由它开始时间轴、恢复直播和计算played
+func (rtmp *RTMPSender) canSendPassthrough(f *dataFrame) (uint32, bool) {
+	clock := &rtmp.clock
+	clock.Lock()
+	defer clock.Unlock()
+	if clock.detached || rtmp.switchPending.Load() || rtmp.completed.Load() {
+		return 0, false
+	}
+	if !clock.started {
+		clock.started = true
+		clock.timeOffset = f.ts
+	}
+	if rtmp.paused.Load() || rtmp.timeshifting.Load() {
+		return 0, false
+	}
+	if clock.engine {
+		// 恢复直播时等待引擎中的帧
+		if rtmp.resuming.Load() {
+			return 0, false
+		}
+		return f.ts - clock.timeOffset, true
+	}
+	if rtmp.resuming.Load() {
+		if !f.keyFrame() {
+			return 0, false
+		}
+		rtmp.resuming.Store(false)
+		if int32(f.ts-clock.lastTS) > 0 {
+			clock.timeOffset += f.ts - clock.lastTS
+		}
+		clock.counting = false
+		rtmp.audio.firstSent.Store(false)
+		rtmp.video.firstSent.Store(false)
+	}
+	clock.advance(f.ts)
+	return f.ts - clock.timeOffset, true
+}
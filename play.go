@@ -0,0 +1,58 @@
+package rtmp
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+)
+
+func hasPublisher(streamPath string) bool {
+	s := Streams.Get(streamPath)
+	return s != nil && s.Publisher != nil
+}
+
+// play的start：-1只播放直播流，-2（默认）有直播时播放直播，否则等待发布者，大于等于0从该位置（秒）回看
+const (
+	playStartLiveOnly       = -1
+	playStartLiveOrRecorded = -2
+)
+
+// normalizeStart 部分客户端（如ffmpeg）以毫秒为单位发送-1000、-2000，其他负数按-2处理
+func normalizeStart(start float64) float64 {
+	switch {
+	case start == playStartLiveOnly || start == -1000:
+		return playStartLiveOnly
+	case start < 0:
+		return playStartLiveOrRecorded
+	}
+	return start
+}
+
+// waitPublisher start为-2时，超时后仍没有发布者则响应NetStream.Play.StreamNotFound并停止播放
+func (s *RTMPSubscriber) waitPublisher(tid uint64, timeout time.Duration) {
+	if timeout <= 0 || hasPublisher(s.Stream.Path) {
+		return
+	}
+	time.AfterFunc(timeout, func() {
+		if !s.IsClosed() && !hasPublisher(s.Stream.Path) {
+			s.SendStatus(tid, NetStream_Play_StreamNotFound, Level_Error, "no publisher in "+timeout.String())
+			s.Stop(zap.String("reason", "wait publisher timeout"))
+		}
+	})
+}
+
+// checkDuration 在发送帧之后调用，已播放的媒体时长（不包括暂停，seek时不计跳过的部分）
+// 达到play的duration时发送NetStream.Play.Complete和StreamEOF并停止播放
+func (rtmp *RTMPSender) checkDuration() {
+	if rtmp.duration == 0 || rtmp.clock.playedTime() < rtmp.duration || !rtmp.completed.CompareAndSwap(false, true) {
+		return
+	}
+	rtmp.aggregate.flush()
+	rtmp.SendMessage(RTMP_MSG_AMF0_METADATA, &DataMessage{"onPlayStatus", []any{map[string]any{
+		"code":  NetStream_Play_Complete,
+		"level": Level_Status,
+	}}, rtmp.StreamID})
+	rtmp.SendStreamID(RTMP_USER_STREAM_EOF, rtmp.StreamID)
+	rtmp.Stop(zap.String("reason", "play complete"))
+}
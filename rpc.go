@@ -0,0 +1,247 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// RPCMessage NetConnection.call调用的方法，命令名为方法名，参数在命令对象之后
+type RPCMessage struct {
+	CommandMessage
+	Object any
+	Args   []any
+}
+
+func (msg *RPCMessage) Encode(buf util.IAMF) {
+	buf.Marshals(msg.CommandName, msg.TransactionId, msg.Object)
+	if len(msg.Args) > 0 {
+		buf.Marshals(msg.Args...)
+	}
+}
+
+// RPCHandler 处理客户端调用的方法，返回值作为_result的参数，返回错误时响应_error。
+// 每次调用在单独的协程中执行，可以调用NetConnection.Call等待客户端回复
+type RPCHandler func(ctx context.Context, nc *NetConnection, args ...any) (any, error)
+
+var rpcHandlers sync.Map // name -> RPCHandler
+
+// RegisterRPC 注册可以被客户端调用的方法，同名的方法会被替换
+func RegisterRPC(name string, handler RPCHandler) {
+	rpcHandlers.Store(name, handler)
+}
+
+// maxConcurrentRPC 每个连接同时执行的客户端调用的最大数量
+const maxConcurrentRPC = 8
+
+var (
+	errTooManyCalls      = errors.New("too many concurrent calls")
+	errCheckingBandwidth = errors.New("bandwidth check in progress")
+)
+
+func init() {
+	RegisterRPC("getStreamLength", getStreamLength)
+	RegisterRPC("getServerTime", getServerTime)
+	RegisterRPC("checkBandwidth", checkBandwidth)
+	RegisterRPC("_checkbw", checkBandwidth)
+}
+
+// startRPC 在读取协程中调用，在新的协程中执行方法。正在执行的调用达到maxConcurrentRPC时直接响应_error
+func (nc *NetConnection) startRPC(ctx context.Context, msg *RPCMessage) {
+	select {
+	case nc.rpcSlots <- struct{}{}:
+		go func() {
+			defer func() { <-nc.rpcSlots }()
+			nc.serveRPC(ctx, msg)
+		}()
+	default:
+		nc.respondRPC(msg, nil, errTooManyCalls)
+	}
+}
+
+// serveRPC 调用注册的方法并回复
+func (nc *NetConnection) serveRPC(ctx context.Context, msg *RPCMessage) error {
+	var result any
+	var err error
+	if nc.connectInfo == nil {
+		err = errors.New("not connected")
+	} else if handler, ok := rpcHandlers.Load(msg.CommandName); ok {
+		result, err = handler.(RPCHandler)(ctx, nc, msg.Args...)
+	} else {
+		err = errors.New("method not found: " + msg.CommandName)
+	}
+	return nc.respondRPC(msg, result, err)
+}
+
+// respondRPC 回复_result或者_error，TransactionId为0表示客户端没有指定Responder，不需要回复
+func (nc *NetConnection) respondRPC(msg *RPCMessage, result any, err error) error {
+	if msg.TransactionId == 0 {
+		return nil
+	}
+	response := &RPCMessage{CommandMessage{Response_Result, msg.TransactionId}, nil, []any{result}}
+	if err != nil {
+		RTMPPlugin.Warn("rpc", zap.String("method", msg.CommandName), zap.Error(err))
+		response.CommandName = Response_Error
+		response.Args = []any{map[string]any{
+			"level":       Level_Error,
+			"code":        NetConnection_Call_Failed,
+			"description": err.Error(),
+		}}
+	}
+	return nc.SendMessage(RTMP_MSG_AMF0_COMMAND, response)
+}
+
+// createStream 作为客户端发送createStream，之后TransactionId为2的响应解析为ResponseCreateStreamMessage
+func (nc *NetConnection) createStream() error {
+	nc.creatingStream.Store(true)
+	return nc.SendMessage(RTMP_MSG_AMF0_COMMAND, &CommandMessage{"createStream", 2})
+}
+
+// decodeMessage 只在等待createStream的响应时特殊处理TransactionId为2的响应，收到后不再等待
+func (nc *NetConnection) decodeMessage(chunk *Chunk, body util.Buffer) error {
+	err := getRtmpMessage(chunk, body, nc.creatingStream.Load())
+	if _, ok := chunk.MsgData.(*ResponseCreateStreamMessage); ok {
+		nc.creatingStream.Store(false)
+	}
+	return err
+}
+
+// Call 调用客户端的方法并等待_result或者_error，ctx结束时放弃等待
+func (nc *NetConnection) Call(ctx context.Context, method string, args ...any) (any, error) {
+	ch := make(chan *ResponseMessage, 1)
+	nc.callLock.Lock()
+	nc.callID++
+	// 避开createStream的响应使用的2
+	tid := nc.callID + 2
+	if nc.calls == nil {
+		nc.calls = make(map[uint64]chan *ResponseMessage)
+	}
+	nc.calls[tid] = ch
+	nc.callLock.Unlock()
+	defer func() {
+		nc.callLock.Lock()
+		delete(nc.calls, tid)
+		nc.callLock.Unlock()
+	}()
+	if err := nc.SendMessage(RTMP_MSG_AMF0_COMMAND, &RPCMessage{CommandMessage{method, tid}, nil, args}); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case response := <-ch:
+		if response.CommandName == Response_Error {
+			description, _ := response.Infomation["description"].(string)
+			if description == "" {
+				description, _ = response.Infomation["code"].(string)
+			}
+			return nil, errors.New(method + ": " + description)
+		}
+		return response.Result, nil
+	}
+}
+
+// resolveCall 把客户端的回复交给等待中的Call
+func (nc *NetConnection) resolveCall(response *ResponseMessage) {
+	nc.callLock.Lock()
+	ch := nc.calls[response.TransactionId]
+	nc.callLock.Unlock()
+	if ch != nil {
+		select {
+		case ch <- response:
+		default:
+		}
+	}
+}
+
+// getStreamLength 返回流的时长（秒），推流端元数据中有duration时以其为准，否则为时移窗口的长度，直播流为0。
+// 与play一样需要应用允许播放并通过播放鉴权
+func getStreamLength(ctx context.Context, nc *NetConnection, args ...any) (any, error) {
+	name, _ := firstArg(args).(string)
+	if name == "" {
+		return nil, errors.New("getStreamLength: stream name required")
+	}
+	app := conf.findApp(nc.connectInfo.Vhost, nc.appName)
+	if app == nil {
+		return nil, errors.New("invalid app " + nc.appName)
+	}
+	info, app := conf.resolveStream(nc, app, strings.TrimPrefix(name, "/"))
+	if app == nil || !app.CanPlay() {
+		return nil, errors.New("play not allowed")
+	}
+	if err := app.PlayAuth.authorizePlay(info); err != nil {
+		return nil, err
+	}
+	if m := findMetaData(info.StreamPath); m != nil && m.Duration > 0 {
+		return m.Duration, nil
+	}
+	if dvr := findDVR(info.StreamPath); dvr != nil {
+		if first, last, ok := dvr.Range(); ok {
+			return float64(last-first) / 1000, nil
+		}
+	}
+	return float64(0), nil
+}
+
+// getServerTime 返回服务器的Unix时间（毫秒）
+func getServerTime(ctx context.Context, nc *NetConnection, args ...any) (any, error) {
+	return float64(time.Now().UnixMilli()), nil
+}
+
+// checkBandwidth 每个连接同时只进行一次带宽检测
+func checkBandwidth(ctx context.Context, nc *NetConnection, args ...any) (any, error) {
+	if !nc.checkingBW.CompareAndSwap(false, true) {
+		return nil, errCheckingBandwidth
+	}
+	go func() {
+		defer nc.checkingBW.Store(false)
+		nc.checkBandwidth(ctx)
+	}()
+	return nil, nil
+}
+
+// checkBandwidth 兼容FMS的带宽检测：先用空的onBWCheck测量延迟，再发送一段数据测量下行带宽，最后调用客户端的onBWDone
+func (nc *NetConnection) checkBandwidth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := nc.Call(ctx, "onBWCheck"); err != nil {
+		RTMPPlugin.Debug("checkBandwidth", zap.Error(err))
+		return
+	}
+	latency := time.Since(start)
+	// AMF0编码时每个数字占9字节
+	payload := make([]any, 4096)
+	for i := range payload {
+		payload[i] = float64(rand.Intn(256))
+	}
+	start = time.Now()
+	// 与FMS的带宽检测脚本(client.call("onBWCheck", res, client.payload))相同，payload作为一个数组参数，
+	// 客户端的onBWCheck只需要返回，不使用参数
+	if _, err := nc.Call(ctx, "onBWCheck", payload); err != nil {
+		RTMPPlugin.Debug("checkBandwidth", zap.Error(err))
+		return
+	}
+	deltaTime := time.Since(start) - latency
+	if deltaTime < time.Millisecond {
+		deltaTime = time.Millisecond
+	}
+	deltaDown := float64(len(payload)*9) / 1024
+	kbitDown := deltaDown * 8 / deltaTime.Seconds()
+	nc.SendMessage(RTMP_MSG_AMF0_COMMAND, &RPCMessage{CommandMessage{"onBWDone", 0}, nil, []any{
+		kbitDown, deltaDown, float64(deltaTime.Milliseconds()), float64(latency.Milliseconds()),
+	}})
+}
+
+func firstArg(args []any) any {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor 等待条件成立，超时后测试失败
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func newRPCConn() *NetConnection {
+	nc := NewNetConnection(&bufferConn{reader: bytes.NewReader(nil)})
+	nc.appName = "live"
+	nc.connectInfo = newConnectInfo(map[string]any{"app": "live", "tcUrl": "rtmp://host/live"}, "10.0.0.1:5000")
+	return nc
+}
+
+// 每个连接同时执行的调用不超过maxConcurrentRPC个，超过的直接响应错误，不执行处理函数
+func TestRPCConcurrency(t *testing.T) {
+	var started atomic.Int32
+	release := make(chan struct{})
+	RegisterRPC("testBlock", func(ctx context.Context, nc *NetConnection, args ...any) (any, error) {
+		started.Add(1)
+		<-release
+		return nil, nil
+	})
+	t.Cleanup(func() { rpcHandlers.Delete("testBlock") })
+	nc := newRPCConn()
+	for i := 0; i < maxConcurrentRPC+2; i++ {
+		nc.startRPC(context.Background(), &RPCMessage{CommandMessage: CommandMessage{CommandName: "testBlock"}})
+	}
+	waitFor(t, func() bool { return started.Load() == maxConcurrentRPC })
+	time.Sleep(10 * time.Millisecond)
+	if n := started.Load(); n != maxConcurrentRPC {
+		t.Fatalf("%d calls running", n)
+	}
+	close(release)
+	waitFor(t, func() bool { return len(nc.rpcSlots) == 0 })
+	nc.startRPC(context.Background(), &RPCMessage{CommandMessage: CommandMessage{CommandName: "testBlock"}})
+	waitFor(t, func() bool { return started.Load() == maxConcurrentRPC+1 })
+}
+
+// 带宽检测结束之前不能开始新的检测
+func TestCheckBandwidthOnce(t *testing.T) {
+	nc := newRPCConn()
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := checkBandwidth(ctx, nc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkBandwidth(ctx, nc); err != errCheckingBandwidth {
+		t.Fatalf("second check: %v", err)
+	}
+	// 客户端没有回复onBWCheck，取消后检测结束
+	cancel()
+	waitFor(t, func() bool { return !nc.checkingBW.Load() })
+	ctx, cancel = context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		waitFor(t, func() bool { return !nc.checkingBW.Load() })
+	}()
+	if _, err := checkBandwidth(ctx, nc); err != nil {
+		t.Fatalf("check after the previous one ended: %v", err)
+	}
+}
+
+// getStreamLength与play一样检查应用是否允许播放和播放鉴权
+func TestGetStreamLength(t *testing.T) {
+	oldApps, oldAuth := conf.Apps, conf.PlayAuth
+	conf.Apps = map[string]AppConfig{"live": {}, "ingest": {Allow: AllowPublish}}
+	conf.PlayAuth = AuthConfig{Keys: map[string]string{"*": "k"}}
+	t.Cleanup(func() { conf.Apps, conf.PlayAuth = oldApps, oldAuth })
+	dvrs.Store("live/test", newTestDVR(DVRConfig{}, 2000))
+	t.Cleanup(func() { dvrs.Delete("live/test") })
+
+	tests := []struct {
+		app, name string
+		length    any
+		ok        bool
+	}{
+		{"live", "test?key=k", 2.0, true},
+		{"live", "/test?key=k", 2.0, true},
+		{"live", "other?key=k", 0.0, true},
+		{"live", "test", nil, false},
+		{"live", "test?key=k&vhost=other", nil, false},
+		{"ingest", "test?key=k", nil, false},
+		{"live", "", nil, false},
+	}
+	for _, tt := range tests {
+		nc := newRPCConn()
+		nc.appName = tt.app
+		length, err := getStreamLength(context.Background(), nc, tt.name)
+		if (err == nil) != tt.ok || length != tt.length {
+			t.Errorf("%s %s: %v, %v", tt.app, tt.name, length, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// RTMPE_HANDSHAKE_VERSION RTMPE的C0/S0，握手使用complex handshake，key中放置DH公钥
+const RTMPE_HANDSHAKE_VERSION = 0x06
+
+// RTMPE使用RFC 2409中1024位的Oakley Group 2，生成元为2
+var (
+	dhPrime, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+			"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+			"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+			"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+			"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+			"FFFFFFFFFFFFFFFF", 16)
+	dhGenerator = big.NewInt(2)
+)
+
+// dhKey 握手中交换的DH密钥对，公钥和共享密钥都是128字节
+type dhKey struct {
+	private *big.Int
+	public  []byte
+}
+
+func newDHKey() (*dhKey, error) {
+	private, err := rand.Int(rand.Reader, dhPrime)
+	if err != nil {
+		return nil, err
+	}
+	public := new(big.Int).Exp(dhGenerator, private, dhPrime)
+	return &dhKey{private, public.FillBytes(make([]byte, C1S1_KEY_DATA_SIZE))}, nil
+}
+
+// sharedSecret 根据对端的公钥计算共享密钥，公钥需要在(1, p-1)之间
+func (k *dhKey) sharedSecret(peer []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(peer)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(dhPrime, big.NewInt(1))) >= 0 {
+		return nil, errors.New("invalid DH public key")
+	}
+	secret := new(big.Int).Exp(y, k.private, dhPrime)
+	return secret.FillBytes(make([]byte, C1S1_KEY_DATA_SIZE)), nil
+}
+
+// rc4Conn 握手后所有读写都经过RC4加密，读取时先解密握手期间已经缓冲的数据
+type rc4Conn struct {
+	net.Conn
+	reader io.Reader
+	in     *rc4.Cipher
+	out    *rc4.Cipher
+	sync.Mutex
+}
+
+func (c *rc4Conn) Read(p []byte) (n int, err error) {
+	n, err = c.reader.Read(p)
+	c.in.XORKeyStream(p[:n], p[:n])
+	return
+}
+
+// Write 不能修改调用者的数据，另外加密到新的缓冲区
+func (c *rc4Conn) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	buf := make([]byte, len(p))
+	c.out.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// encrypt 握手完成后开启RC4加密。密钥为共享密钥对公钥的HMAC-SHA256的前16字节：
+// 发送使用对端的公钥，接收使用自己的公钥。两个方向都先丢弃1536字节的密钥流
+func (nc *NetConnection) encrypt(dh *dhKey, peer []byte) error {
+	secret, err := dh.sharedSecret(peer)
+	if err != nil {
+		return err
+	}
+	outKey, _ := HMAC_SHA256(peer, secret)
+	inKey, _ := HMAC_SHA256(dh.public, secret)
+	out, err := rc4.NewCipher(outKey[:16])
+	if err != nil {
+		return err
+	}
+	in, err := rc4.NewCipher(inKey[:16])
+	if err != nil {
+		return err
+	}
+	skip := make([]byte, C1S1_SIZE)
+	in.XORKeyStream(skip, skip)
+	out.XORKeyStream(skip, skip)
+	buffered, _ := nc.Reader.Peek(nc.Reader.Buffered())
+	conn := &rc4Conn{
+		Conn:   nc.Conn,
+		reader: io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), nc.Conn),
+		in:     in,
+		out:    out,
+	}
+	nc.Conn = conn
+	nc.Reader = bufio.NewReader(conn)
+	return nil
+}
+
+// ClientHandshakeRTMPE 以RTMPE发起complex handshake，C1使用scheme0，服务端的S1可以是任意一种scheme
+func (client *NetConnection) ClientHandshakeRTMPE() error {
+	return client.clientComplexHandshake(RTMPE_HANDSHAKE_VERSION, 0)
+}
+
+// clientComplexHandshake C1使用指定的scheme发起complex handshake，version为RTMPE时key中放置DH公钥，握手后开启RC4加密
+func (client *NetConnection) clientComplexHandshake(version byte, C1Scheme int) (err error) {
+	var dh *dhKey
+	C0C1 := make([]byte, C1S1_SIZE+1)
+	C0C1[0] = version
+	C1 := C0C1[1:]
+	copy(C1[4:8], []byte{128, 0, 3, 2}) // Flash Player 128.0.3.2，与librtmp相同
+	rand.Read(C1[8:])
+	if version == RTMPE_HANDSHAKE_VERSION {
+		if dh, err = newDHKey(); err != nil {
+			return err
+		}
+		copy(C1[scheme_Key_Offset(C1, C1Scheme):][:C1S1_KEY_DATA_SIZE], dh.public)
+	}
+	digestOffset := scheme_Digest_Offset(C1, C1Scheme)
+	copy(C1[digestOffset:], c1s1Digest(C1, digestOffset, FP_KEY[:30]))
+	if _, err = client.Write(C0C1); err != nil {
+		return
+	}
+	S0S1 := make([]byte, C1S1_SIZE+1)
+	if _, err = io.ReadFull(client.Reader, S0S1); err != nil {
+		return
+	}
+	if S0S1[0] != version {
+		return errors.New("S0 Error")
+	}
+	S1 := S0S1[1:]
+	scheme := -1
+	for _, s := range []int{0, 1} {
+		offset := scheme_Digest_Offset(S1, s)
+		if bytes.Equal(S1[offset:offset+C1S1_DIGEST_DATA_SIZE], c1s1Digest(S1, offset, FMS_KEY[:36])) {
+			scheme = s
+			break
+		}
+	}
+	if scheme < 0 {
+		return errors.New("S1 Error")
+	}
+	serverDigestOffset := scheme_Digest_Offset(S1, scheme)
+	serverKey := S1[scheme_Key_Offset(S1, scheme):][:C1S1_KEY_DATA_SIZE]
+	// C2: 随机数据 + 以S1的digest计算的签名
+	C2 := make([]byte, C1S1_SIZE)
+	rand.Read(C2[:C1S1_SIZE-C1S1_DIGEST_DATA_SIZE])
+	tmp_Hash, _ := HMAC_SHA256(S1[serverDigestOffset:serverDigestOffset+C1S1_DIGEST_DATA_SIZE], FP_KEY[:62])
+	signature, _ := HMAC_SHA256(C2[:C1S1_SIZE-C1S1_DIGEST_DATA_SIZE], tmp_Hash)
+	copy(C2[C1S1_SIZE-C1S1_DIGEST_DATA_SIZE:], signature)
+	if _, err = client.Write(C2); err != nil {
+		return
+	}
+	S2 := make([]byte, C1S1_SIZE)
+	if _, err = io.ReadFull(client.Reader, S2); err != nil {
+		return
+	}
+	tmp_Hash, _ = HMAC_SHA256(C1[digestOffset:digestOffset+C1S1_DIGEST_DATA_SIZE], FMS_KEY[:68])
+	signature, _ = HMAC_SHA256(S2[:C1S1_SIZE-C1S1_DIGEST_DATA_SIZE], tmp_Hash)
+	if !bytes.Equal(signature, S2[C1S1_SIZE-C1S1_DIGEST_DATA_SIZE:]) {
+		return errors.New("S2 Error")
+	}
+	if dh == nil {
+		return nil
+	}
+	return client.encrypt(dh, serverKey)
+}
+
+// c1s1Digest 计算C1/S1中除digest以外的部分的HMAC-SHA256
+func c1s1Digest(C1S1 []byte, offset int, key []byte) []byte {
+	buf := make([]byte, 0, C1S1_SIZE-C1S1_DIGEST_DATA_SIZE)
+	buf = append(buf, C1S1[:offset]...)
+	buf = append(buf, C1S1[offset+C1S1_DIGEST_DATA_SIZE:]...)
+	digest, _ := HMAC_SHA256(buf, key)
+	return digest
+}
@@ -0,0 +1,159 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordConn 记录写入网络的数据，用来确认握手后的数据已经加密
+type recordConn struct {
+	net.Conn
+	sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.Lock()
+	c.written.Write(p)
+	c.Unlock()
+	return c.Conn.Write(p)
+}
+
+// 服务端回显收到的帧，客户端发送的帧经过服务端后应该原样返回
+func TestRTMPELoopback(t *testing.T) {
+	frames := [][]byte{
+		unhex("17 00 000000 01 64 00 1f ff e1 00 04 67 64 00 1f"),
+		unhex("17 01 000028 00000005 65 88 84 00 33"),
+		bytes.Repeat([]byte{0xAA}, 5000), // 超过bufio的缓冲区
+	}
+	tests := []struct {
+		name    string
+		version byte
+		scheme  int
+	}{
+		{"rtmpe scheme0", RTMPE_HANDSHAKE_VERSION, 0},
+		{"rtmpe scheme1", RTMPE_HANDSHAKE_VERSION, 1},
+		{"rtmp scheme0", RTMP_HANDSHAKE_VERSION, 0},
+		{"rtmp scheme1", RTMP_HANDSHAKE_VERSION, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			served := make(chan error, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					served <- err
+					return
+				}
+				defer conn.Close()
+				nc := NewNetConnection(conn)
+				if err = nc.Handshake(); err == nil {
+					_, err = io.Copy(nc, nc.Reader)
+				}
+				served <- err
+			}()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			record := &recordConn{Conn: conn}
+			client := NewNetConnection(record)
+			if err = client.clientComplexHandshake(tt.version, tt.scheme); err != nil {
+				t.Fatal(err)
+			}
+			handshakeSize := record.written.Len()
+			go func() {
+				for _, frame := range frames {
+					client.Write(frame)
+				}
+			}()
+			for i, frame := range frames {
+				got := make([]byte, len(frame))
+				if _, err = io.ReadFull(client.Reader, got); err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if !bytes.Equal(got, frame) {
+					t.Fatalf("frame %d: got %x", i, got)
+				}
+			}
+			record.Lock()
+			encrypted := !bytes.Contains(record.written.Bytes()[handshakeSize:], frames[1])
+			record.Unlock()
+			if encrypted != (tt.version == RTMPE_HANDSHAKE_VERSION) {
+				t.Errorf("encrypted on the wire: %v", encrypted)
+			}
+			conn.(*net.TCPConn).CloseWrite()
+			if err = <-served; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// bufferConn 从reader读取，写入到written
+type bufferConn struct {
+	net.Conn
+	reader  io.Reader
+	written bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c *bufferConn) Write(p []byte) (int, error) { return c.written.Write(p) }
+
+// 推流端在C2之后立即发送的数据在开启加密之前已经被读入bufio.Reader，也需要解密
+func TestEncryptBufferedData(t *testing.T) {
+	serverDH, err := newDHKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDH, err := newDHKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn := &bufferConn{reader: bytes.NewReader(nil)}
+	client := NewNetConnection(clientConn)
+	if err = client.encrypt(clientDH, serverDH.public); err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("connect createStream publish")
+	client.Write(message)
+	client.Write(message)
+
+	C2 := make([]byte, C1S1_SIZE)
+	server := NewNetConnection(&bufferConn{reader: bytes.NewReader(append(C2, clientConn.written.Bytes()...))})
+	ReadBuf(server.Reader, C1S1_SIZE)
+	if server.Reader.Buffered() == 0 {
+		t.Fatal("nothing buffered before encrypt")
+	}
+	if err = server.encrypt(serverDH, clientDH.public); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(server.Reader)
+	if want := append(append([]byte(nil), message...), message...); !bytes.Equal(got, want) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// scheme1的key在digest之前，key的数据不能越过保存偏移量的最后4字节
+func TestSchemeKeyOffset(t *testing.T) {
+	C1 := make([]byte, C1S1_SIZE)
+	for i := range C1 {
+		C1[i] = 0xFF
+	}
+	keyEnd := C1S1_TIME_SIZE + C1S1_VERSION_SIZE + C1S1_KEY_SIZE - C1S1_KEY_OFFSET_SIZE
+	if offset := scheme1_Key_Offset(C1); offset != 8+1020%C1S1_KEY_OFFSET_MAX || offset+C1S1_KEY_DATA_SIZE > keyEnd {
+		t.Errorf("scheme1 key offset %d", offset)
+	}
+	if offset := scheme0_Key_Offset(C1); offset != 8+C1S1_DIGEST_SIZE+1020%C1S1_KEY_OFFSET_MAX || offset+C1S1_KEY_DATA_SIZE > C1S1_SIZE-C1S1_KEY_OFFSET_SIZE {
+		t.Errorf("scheme0 key offset %d", offset)
+	}
+}
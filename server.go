@@ -2,9 +2,11 @@ package rtmp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"go.uber.org/zap"
 	"m7s.live/engine/v4"
@@ -12,21 +14,43 @@ import (
 
 type NetStream struct {
 	*NetConnection
-	StreamID uint32
+	StreamID   uint32
+	streamInfo *StreamInfo
 }
 
 func (ns *NetStream) Begin() {
 	ns.SendStreamID(RTMP_USER_STREAM_BEGIN, ns.StreamID)
 }
 
+// SendStatus 发送带描述的onStatus消息
+func (ns *NetStream) SendStatus(tid uint64, code, level, description string) error {
+	m := new(ResponsePlayMessage)
+	m.CommandName = Response_OnStatus
+	m.TransactionId = tid
+	m.Infomation = map[string]any{
+		"code":        code,
+		"level":       level,
+		"description": description,
+	}
+	m.StreamID = ns.StreamID
+	return ns.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
+}
+
 type RTMPSubscriber struct {
 	RTMPSender
+	tracks []*trackSender // 以Multitrack包发送的附加轨道
 }
 
 func (s *RTMPSubscriber) OnEvent(event any) {
 	switch event.(type) {
 	case engine.SEclose:
-		s.Response(0, NetStream_Play_Stop, Level_Status)
+		// 被play2替换或者达到duration时已经通知过客户端
+		if !s.switched.Load() && !s.completed.Load() {
+			s.Response(0, NetStream_Play_Stop, Level_Status)
+		}
+		for _, t := range s.tracks {
+			t.Stop()
+		}
 	}
 	s.RTMPSender.OnEvent(event)
 }
@@ -37,17 +61,23 @@ func (config *RTMPConfig) ServeTCP(conn net.Conn) {
 	receivers := make(map[uint32]*RTMPReceiver)
 	var err error
 	logger.Info("conn")
+	nc := NewNetConnection(conn)
 	defer func() {
 		ze := zap.Error(err)
 		logger.Info("conn close", ze)
 		for _, sender := range senders {
 			sender.Stop(ze)
+			config.Hook.Notify(sender.streamInfo.hookEvent(HookStop))
 		}
 		for _, receiver := range receivers {
 			receiver.Stop(ze)
+			config.Hook.Notify(receiver.streamInfo.hookEvent(HookUnpublish))
+		}
+		nc.releaseSharedObjects()
+		if nc.connectInfo != nil {
+			config.Hook.Notify(newHookEvent(HookClose, nc.connectInfo))
 		}
 	}()
-	nc := NewNetConnection(conn)
 	ctx, cancel := context.WithCancel(engine.Engine)
 	defer cancel()
 	/* Handshake */
@@ -57,13 +87,14 @@ func (config *RTMPConfig) ServeTCP(conn net.Conn) {
 	}
 	var msg *Chunk
 	var gstreamid uint32
+	var app *AppConfig // connect成功后才有值，之前的publish和play会被拒绝
 	for {
 		if msg, err = nc.RecvMessage(); err == nil {
 			if msg.MessageLength <= 0 {
 				continue
 			}
 			switch msg.MessageTypeID {
-			case RTMP_MSG_AMF0_COMMAND:
+			case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF3_COMMAND:
 				if msg.MsgData == nil {
 					break
 				}
@@ -71,7 +102,12 @@ func (config *RTMPConfig) ServeTCP(conn net.Conn) {
 				logger.Debug("recv cmd", zap.String("commandName", cmd.CommandName), zap.Uint32("streamID", msg.MessageStreamID))
 				switch cmd := msg.MsgData.(type) {
 				case *CallMessage: //connect
-					app := cmd.Object["app"]                       // 客户端要连接到的服务应用名
+					if nc.connectInfo != nil {
+						// 处理方法调用的协程会读取连接信息，不允许再次connect修改
+						logger.Warn("connect again ignored")
+						break
+					}
+					appName := cmd.Object["app"]                   // 客户端要连接到的服务应用名
 					objectEncoding := cmd.Object["objectEncoding"] // AMF编码方法
 					switch v := objectEncoding.(type) {
 					case float64:
@@ -79,11 +115,35 @@ func (config *RTMPConfig) ServeTCP(conn net.Conn) {
 					default:
 						nc.objectEncoding = 0
 					}
-					nc.appName = app.(string)
+					nc.appName = appName.(string)
 					logger.Info("connect", zap.String("appName", nc.appName), zap.Float64("objectEncoding", nc.objectEncoding))
+					nc.connectInfo = newConnectInfo(cmd.Object, conn.RemoteAddr().String())
+					nc.caps = parseCapabilities(cmd.Object)
+					if app = config.findApp(nc.connectInfo.Vhost, nc.appName); app == nil {
+						err = errors.New("invalid app " + nc.appName)
+						logger.Warn("connect rejected", zap.Error(err))
+						nc.RejectConnect(cmd.TransactionId, NetConnection_Connect_InvalidApp, err.Error())
+						return
+					}
+					if err = authorizeConnect(app.PublishAuth, app.PlayAuth, nc.connectInfo); err != nil {
+						logger.Warn("connect rejected", zap.Error(err))
+						nc.RejectConnect(cmd.TransactionId, NetConnection_Connect_Rejected, err.Error())
+						return
+					}
+					var redirect string
+					if redirect, err = config.Hook.Call(newHookEvent(HookConnect, nc.connectInfo)); err != nil {
+						logger.Warn("connect rejected by hook", zap.Error(err))
+						nc.RejectConnect(cmd.TransactionId, NetConnection_Connect_Rejected, err.Error())
+						return
+					} else if redirect != "" {
+						logger.Info("connect redirect", zap.String("location", redirect))
+						nc.RedirectConnect(cmd.TransactionId, redirect)
+						return
+					}
+					nc.appPath = app.appPath(nc.appName)
 					err = nc.SendMessage(RTMP_MSG_ACK_SIZE, Uint32Message(512<<10))
-					nc.writeChunkSize = config.ChunkSize
-					err = nc.SendMessage(RTMP_MSG_CHUNK_SIZE, Uint32Message(config.ChunkSize))
+					nc.writeChunkSize = app.ChunkSize
+					err = nc.SendMessage(RTMP_MSG_CHUNK_SIZE, Uint32Message(app.ChunkSize))
 					err = nc.SendMessage(RTMP_MSG_BANDWIDTH, &SetPeerBandwidthMessage{
 						AcknowledgementWindowsize: uint32(512 << 10),
 						LimitType:                 byte(2),
@@ -98,20 +158,50 @@ func (config *RTMPConfig) ServeTCP(conn net.Conn) {
 						"mode":         1,
 						"Author":       "dexter",
 					}
+					for k, v := range localCapabilities() {
+						m.Properties[k] = v
+					}
 					m.Infomation = map[string]any{
 						"level":          Level_Status,
 						"code":           NetConnection_Connect_Success,
 						"objectEncoding": nc.objectEncoding,
 					}
 					err = nc.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
+				case *RPCMessage:
+					// 处理函数可能调用nc.Call等待客户端的回复，不能阻塞读取协程
+					nc.startRPC(ctx, cmd)
+				case *ResponseMessage:
+					nc.resolveCall(cmd)
 				case *CommandMessage: // "createStream"
 					gstreamid++
 					logger.Info("createStream:", zap.Uint32("streamId", gstreamid))
 					nc.ResponseCreateStream(cmd.TransactionId, gstreamid)
 				case *CURDStreamMessage:
 					if stream, ok := receivers[cmd.StreamId]; ok {
+						stream.Stop()
+						delete(receivers, cmd.StreamId)
+						config.Hook.Notify(stream.streamInfo.hookEvent(HookUnpublish))
+					}
+					if stream, ok := senders[cmd.StreamId]; ok {
 						stream.Stop()
 						delete(senders, cmd.StreamId)
+						config.Hook.Notify(stream.streamInfo.hookEvent(HookStop))
+					}
+				case *PauseMessage:
+					if sender, ok := senders[msg.MessageStreamID]; ok {
+						if cmd.Pause {
+							sender.Pause()
+							sender.SendStreamID(RTMP_USER_STREAM_EOF, sender.StreamID)
+							err = sender.Response(cmd.TransactionId, NetStream_Pause_Notify, Level_Status)
+						} else {
+							sender.Unpause()
+							sender.Begin()
+							err = sender.Response(cmd.TransactionId, NetStream_Unpause_Notify, Level_Status)
+						}
+					}
+				case *SeekMessage:
+					if sender, ok := senders[msg.MessageStreamID]; ok {
+						err = sender.seek(cmd.TransactionId, uint32(cmd.Milliseconds))
 					}
 				case *ReleaseStreamMessage:
 					// m := &CommandMessage{
@@ -128,17 +218,55 @@ func (config *RTMPConfig) ServeTCP(conn net.Conn) {
 					// }
 					// err = nc.SendMessage(RTMP_MSG_AMF0_COMMAND, m)
 				case *PublishMessage:
+					if app == nil {
+						err = errors.New("publish before connect")
+						logger.Warn("publish rejected", zap.Error(err))
+						ns := NetStream{NetConnection: nc, StreamID: cmd.StreamId}
+						ns.SendStatus(cmd.TransactionId, NetStream_Publish_BadName, Level_Error, err.Error())
+						return
+					}
+					info, app := config.resolveStream(nc, app, cmd.PublishingName)
 					receiver := &RTMPReceiver{
 						NetStream: NetStream{
 							NetConnection: nc,
 							StreamID:      cmd.StreamId,
+							streamInfo:    info,
 						},
 					}
+					if app == nil {
+						err = errors.New("vhost change not allowed: " + info.Args.Get("vhost"))
+						logger.Warn("publish rejected", zap.String("streamName", info.StreamName), zap.Error(err))
+						receiver.SendStatus(cmd.TransactionId, NetStream_Publish_BadName, Level_Error, err.Error())
+						return
+					}
 					receiver.SetParentCtx(ctx)
-					if !config.KeepAlive {
+					if !*app.KeepAlive {
 						receiver.SetIO(conn)
 					}
-					if RTMPPlugin.Publish(nc.appName+"/"+cmd.PublishingName, receiver) == nil {
+					receiver.Config = app.Publish
+					if !app.CanPublish() {
+						err = errors.New("publish not allowed")
+						logger.Warn("publish rejected", zap.String("streamName", info.StreamName), zap.Error(err))
+						receiver.SendStatus(cmd.TransactionId, NetStream_Publish_BadName, Level_Error, err.Error())
+						return
+					}
+					if err = app.PublishAuth.authorizePublish(info); err != nil {
+						logger.Warn("publish rejected", zap.String("streamName", info.StreamName), zap.Error(err))
+						receiver.SendStatus(cmd.TransactionId, NetStream_Publish_BadName, Level_Error, err.Error())
+						return
+					}
+					var redirect string
+					if redirect, err = config.Hook.Call(info.hookEvent(HookPublish)); err != nil {
+						logger.Warn("publish rejected by hook", zap.String("streamName", info.StreamName), zap.Error(err))
+						receiver.SendStatus(cmd.TransactionId, NetStream_Publish_BadName, Level_Error, err.Error())
+						return
+					} else if redirect != "" {
+						logger.Info("publish renamed by hook", zap.String("streamName", info.StreamName), zap.String("newName", redirect))
+						cmd.PublishingName = redirect
+						receiver.streamInfo = newStreamInfo(nc.connectInfo, app.appPath(nc.appName), redirect)
+					}
+					// 与鉴权使用相同的streamPath，不包含流名称中的参数
+					if RTMPPlugin.Publish(receiver.streamInfo.StreamPath, receiver) == nil {
 						receivers[cmd.StreamId] = receiver
 						receiver.Begin()
 						err = receiver.Response(cmd.TransactionId, NetStream_Publish_Start, Level_Status)
@@ -147,27 +275,168 @@ func (config *RTMPConfig) ServeTCP(conn net.Conn) {
 						err = receiver.Response(cmd.TransactionId, NetStream_Publish_BadName, Level_Error)
 					}
 				case *PlayMessage:
-					streamPath := nc.appName + "/" + cmd.StreamName
+					if app == nil {
+						logger.Warn("play rejected", zap.String("reason", "play before connect"))
+						ns := NetStream{NetConnection: nc, StreamID: cmd.StreamId}
+						err = ns.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, "play before connect")
+						break
+					}
+					info, app := config.resolveStream(nc, app, cmd.StreamName)
 					sender := &RTMPSubscriber{}
 					sender.NetStream = NetStream{
-						nc,
-						cmd.StreamId,
+						NetConnection: nc,
+						StreamID:      cmd.StreamId,
+						streamInfo:    info,
+					}
+					// 播放被拒绝时只响应NetStream.Play.Failed，不断开连接
+					if app == nil {
+						err = errors.New("vhost change not allowed: " + info.Args.Get("vhost"))
+						logger.Warn("play rejected", zap.String("streamName", info.StreamName), zap.Error(err))
+						err = sender.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, err.Error())
+						break
+					}
+					if !app.CanPlay() {
+						err = errors.New("play not allowed")
+						logger.Warn("play rejected", zap.String("streamName", info.StreamName), zap.Error(err))
+						err = sender.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, err.Error())
+						break
+					}
+					if err = app.PlayAuth.authorizePlay(info); err != nil {
+						logger.Warn("play rejected", zap.String("streamName", info.StreamName), zap.Error(err))
+						err = sender.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, err.Error())
+						break
+					}
+					var redirect string
+					if redirect, err = config.Hook.Call(info.hookEvent(HookPlay)); err != nil {
+						logger.Warn("play rejected by hook", zap.String("streamName", info.StreamName), zap.Error(err))
+						err = sender.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, err.Error())
+						break
+					} else if redirect != "" {
+						logger.Info("play renamed by hook", zap.String("streamName", info.StreamName), zap.String("newName", redirect))
+						cmd.StreamName = redirect
+						sender.streamInfo = newStreamInfo(nc.connectInfo, app.appPath(nc.appName), redirect)
+					}
+					streamPath := app.appPath(nc.appName) + "/" + cmd.StreamName
+					start := normalizeStart(cmd.Start)
+					if start == playStartLiveOnly && !hasPublisher(sender.streamInfo.StreamPath) {
+						err = sender.SendStatus(cmd.TransactionId, NetStream_Play_StreamNotFound, Level_Error, "no publisher")
+						break
 					}
 					sender.SetParentCtx(ctx)
-					if !config.KeepAlive {
+					if !*app.KeepAlive {
 						sender.SetIO(conn)
 					}
+					sender.Config = app.Subscribe
 					sender.ID = fmt.Sprintf("%s|%d", conn.RemoteAddr().String(), sender.StreamID)
+					sender.aggregate.size = config.Aggregate
+					sender.aggregate.maxDuration = uint32(config.AggregateDelay / time.Millisecond)
+					if sender.streamInfo.Args.Has("audioOnly") {
+						sender.video.muted.Store(true)
+					}
+					if sender.streamInfo.Args.Has("videoOnly") {
+						sender.audio.muted.Store(true)
+					}
+					sender.captionMode = sender.streamInfo.Args.Get("captions")
+					if cmd.Duration > 0 {
+						sender.duration = uint32(cmd.Duration * 1000)
+					}
 					if RTMPPlugin.Subscribe(streamPath, sender) != nil {
 						sender.Response(cmd.TransactionId, NetStream_Play_Failed, Level_Error)
 					} else {
 						senders[sender.StreamID] = sender
 						sender.Begin()
-						sender.Response(cmd.TransactionId, NetStream_Play_Reset, Level_Status)
+						if cmd.Reset {
+							sender.Response(cmd.TransactionId, NetStream_Play_Reset, Level_Status)
+						}
 						sender.Response(cmd.TransactionId, NetStream_Play_Start, Level_Status)
 						go sender.PlayRaw()
+						sender.subscribeTracks(ctx, app.Subscribe)
+						if dvr := findDVR(sender.streamInfo.StreamPath); start >= 0 && dvr != nil {
+							// 已经响应了Play.Start，不再响应Seek.Notify。开始位置早于时移窗口时从窗口起点开始
+							ms := uint32(start * 1000)
+							if first, _, ok := dvr.Range(); ok && ms < first {
+								ms = first
+							}
+							if err = sender.Seek(ms); err != nil {
+								logger.Warn("play start", zap.String("streamName", sender.streamInfo.StreamName), zap.Error(err))
+								err = nil
+							}
+						} else if start != playStartLiveOnly {
+							// -2，或者没有时移缓冲时的start大于等于0
+							sender.waitPublisher(cmd.TransactionId, config.PlayWaitTimeout)
+						}
+					}
+				case *ReceiveAVMessage:
+					if sender, ok := senders[msg.MessageStreamID]; ok {
+						if cmd.CommandName == "receiveAudio" {
+							sender.audio.SetReceive(cmd.BoolFlag)
+						} else {
+							sender.video.SetReceive(cmd.BoolFlag)
+						}
+					}
+				case *Play2Message:
+					old, ok := senders[msg.MessageStreamID]
+					if !ok {
+						ns := NetStream{NetConnection: nc, StreamID: msg.MessageStreamID}
+						err = ns.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, "play2 without playing stream")
+						break
+					}
+					if cmd.Transition != "switch" && cmd.Transition != "swap" {
+						err = old.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, "unsupported transition "+cmd.Transition)
+						break
+					}
+					if old.switchPending.Load() {
+						// 上一次切换等到关键帧之前不接受新的切换
+						err = old.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, "switch in progress")
+						break
+					}
+					info, app := config.resolveStream(nc, app, cmd.StreamName)
+					if app == nil || !app.CanPlay() {
+						err = old.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, "play not allowed")
+						break
+					}
+					if err = app.PlayAuth.authorizePlay(info); err != nil {
+						logger.Warn("play2 rejected", zap.String("streamName", info.StreamName), zap.Error(err))
+						err = old.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, err.Error())
+						break
+					}
+					var redirect string
+					if redirect, err = config.Hook.Call(info.hookEvent(HookPlay)); err != nil {
+						logger.Warn("play2 rejected by hook", zap.String("streamName", info.StreamName), zap.Error(err))
+						err = old.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, err.Error())
+						break
+					} else if redirect != "" {
+						logger.Info("play2 renamed by hook", zap.String("streamName", info.StreamName), zap.String("newName", redirect))
+						cmd.StreamName = redirect
+						info = newStreamInfo(nc.connectInfo, app.appPath(nc.appName), redirect)
+					}
+					// 与play相同，订阅时保留流名称中的参数
+					streamPath := app.appPath(nc.appName) + "/" + cmd.StreamName
+					sender := newSwitchSender(old, info)
+					sender.SetParentCtx(ctx)
+					if !*app.KeepAlive {
+						sender.SetIO(conn)
+					}
+					sender.Config = app.Subscribe
+					if err = RTMPPlugin.Subscribe(streamPath, sender); err != nil {
+						err = old.SendStatus(cmd.TransactionId, NetStream_Play_Failed, Level_Error, err.Error())
+					} else {
+						logger.Info("play2 switch", zap.String("from", old.Stream.Path), zap.String("to", info.StreamPath))
+						// 旧的订阅者在新流的关键帧处停止，之后不再属于这个连接
+						senders[msg.MessageStreamID] = sender
+						config.Hook.Notify(old.streamInfo.hookEvent(HookStop))
+						go sender.PlayRaw()
+						sender.subscribeTracks(ctx, app.Subscribe)
 					}
 				}
+			case RTMP_MSG_AMF0_SHARED, RTMP_MSG_AMF3_SHARED:
+				if so, ok := msg.MsgData.(*SharedObjectMessage); ok {
+					nc.ReceiveSharedObject(so)
+				}
+			case RTMP_MSG_AMF0_METADATA, RTMP_MSG_AMF3_METADATA:
+				if r, ok := receivers[msg.MessageStreamID]; ok {
+					r.ReceiveData(msg)
+				}
 			case RTMP_MSG_AUDIO:
 				if r, ok := receivers[msg.MessageStreamID]; ok {
 					r.ReceiveAudio(msg)
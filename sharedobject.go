@@ -0,0 +1,433 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// 共享对象消息中的事件类型
+const (
+	RTMP_SO_USE            = 1  // 客户端连接共享对象
+	RTMP_SO_RELEASE        = 2  // 客户端断开共享对象
+	RTMP_SO_REQUEST_CHANGE = 3  // 客户端请求修改属性
+	RTMP_SO_CHANGE         = 4  // 通知客户端属性已被其他客户端修改
+	RTMP_SO_SUCCESS        = 5  // 通知客户端修改请求成功
+	RTMP_SO_SEND_MESSAGE   = 6  // 广播消息，调用所有客户端上的处理函数
+	RTMP_SO_STATUS         = 7  // 状态，例如错误
+	RTMP_SO_CLEAR          = 8  // 通知客户端清空本地数据
+	RTMP_SO_REMOVE         = 9  // 通知客户端属性已被删除
+	RTMP_SO_REQUEST_REMOVE = 10 // 客户端请求删除属性
+	RTMP_SO_USE_SUCCESS    = 11 // 通知客户端连接成功
+)
+
+// SharedObjectEvent 共享对象事件。Change和RequestChange使用Name和Value，
+// SendMessage的Values第一个为处理函数名，Status的Name为状态码，Value为级别
+type SharedObjectEvent struct {
+	Type   byte
+	Name   string
+	Value  any
+	Values []any
+}
+
+// SharedObjectMessage 共享对象消息，类型19用AMF0编码，类型16以一个格式字节开头，其中的值可以切换为AMF3编码
+type SharedObjectMessage struct {
+	Name       string
+	Version    uint32
+	Persistent bool
+	Events     []SharedObjectEvent
+	amf3       bool
+}
+
+func decodeSharedObject(chunk *Chunk, body []byte) error {
+	d := newAMFDecoder(body)
+	name, err := d.readString0()
+	if err != nil {
+		return err
+	}
+	m := &SharedObjectMessage{Name: name}
+	if m.Version, err = d.readUint32(); err != nil {
+		return err
+	}
+	flags, err := d.read(8)
+	if err != nil {
+		return err
+	}
+	m.Persistent = flags[3]&2 != 0
+	for d.Len() > 0 {
+		var e SharedObjectEvent
+		if e.Type, err = d.readByte(); err != nil {
+			return err
+		}
+		n, err := d.readUint32()
+		if err != nil {
+			return err
+		}
+		data, err := d.read(int(n))
+		if err != nil {
+			return err
+		}
+		ed := newAMFDecoder(data)
+		switch e.Type {
+		case RTMP_SO_REQUEST_CHANGE, RTMP_SO_CHANGE:
+			if e.Name, err = ed.readString0(); err == nil && ed.Len() > 0 {
+				e.Value, err = ed.Unmarshal()
+			}
+		case RTMP_SO_SUCCESS, RTMP_SO_REMOVE, RTMP_SO_REQUEST_REMOVE:
+			e.Name, err = ed.readString0()
+		case RTMP_SO_STATUS:
+			if e.Name, err = ed.readString0(); err == nil {
+				e.Value, err = ed.readString0()
+			}
+		case RTMP_SO_SEND_MESSAGE:
+			for ed.Len() > 0 && err == nil {
+				var v any
+				if v, err = ed.Unmarshal(); err == nil {
+					e.Values = append(e.Values, v)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		m.Events = append(m.Events, e)
+	}
+	chunk.MsgData = m
+	return nil
+}
+
+func (msg *SharedObjectMessage) Encode(buf util.IAMF) {
+	if msg.amf3 {
+		buf.WriteByte(0)
+	}
+	buf.WriteUint16(uint16(len(msg.Name)))
+	buf.Write([]byte(msg.Name))
+	buf.WriteUint32(msg.Version)
+	if msg.Persistent {
+		buf.WriteUint32(2)
+	} else {
+		buf.WriteUint32(0)
+	}
+	buf.WriteUint32(0)
+	for i := range msg.Events {
+		data := msg.Events[i].encode(msg.amf3)
+		buf.WriteByte(msg.Events[i].Type)
+		buf.WriteUint32(uint32(len(data)))
+		buf.Write(data)
+	}
+}
+
+func (e *SharedObjectEvent) encode(amf3 bool) []byte {
+	var a avmplusAMF
+	var amf util.IAMF = &a.AMF
+	if amf3 {
+		amf = &a
+	}
+	writeName := func(s string) {
+		amf.WriteUint16(uint16(len(s)))
+		amf.Write([]byte(s))
+	}
+	switch e.Type {
+	case RTMP_SO_REQUEST_CHANGE, RTMP_SO_CHANGE:
+		writeName(e.Name)
+		amf.Marshal(e.Value)
+	case RTMP_SO_SUCCESS, RTMP_SO_REMOVE, RTMP_SO_REQUEST_REMOVE:
+		writeName(e.Name)
+	case RTMP_SO_SEND_MESSAGE:
+		amf.Marshals(e.Values...)
+	case RTMP_SO_STATUS:
+		writeName(e.Name)
+		level, _ := e.Value.(string)
+		writeName(level)
+	}
+	return a.Buffer
+}
+
+// SharedObject 远程共享对象，同一个应用中名称相同的客户端共享同一份数据
+type SharedObject struct {
+	sync.Mutex `json:"-"`
+	App        string         `json:"app"`
+	Name       string         `json:"name"`
+	Persistent bool           `json:"persistent"`
+	Version    uint32         `json:"version"`
+	Data       map[string]any `json:"data"`
+	clients    map[*NetConnection]struct{}
+}
+
+var (
+	sharedObjects     = make(map[string]*SharedObject) // app/name -> *SharedObject
+	sharedObjectsLock sync.Mutex
+)
+
+var errSharedObjectPath = errors.New("shared object path out of SharedObjectDir")
+
+// escapeFileName 转义路径分隔符，开头的.也需要转义，避免名称为..时访问上级目录
+func escapeFileName(name string) string {
+	name = url.PathEscape(name)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+// file 持久化文件的路径，应用和名称中可能包含/，需要转义，转义后仍然检查是否在SharedObjectDir中
+func (so *SharedObject) file() (string, error) {
+	dir := filepath.Clean(conf.SharedObjectDir)
+	file := filepath.Join(dir, escapeFileName(so.App), escapeFileName(so.Name)+".json")
+	if !strings.HasPrefix(file, dir+string(filepath.Separator)) {
+		return "", errSharedObjectPath
+	}
+	return file, nil
+}
+
+// 持久化使用JSON，只能保存数字、字符串、布尔、null以及由它们组成的对象和数组
+var errSharedObjectValue = errors.New("value of persistent shared object must be number, string, boolean, null, object or array")
+
+// persistable 检查值保存为JSON后能否原样恢复。日期、ByteArray、Vector等AMF3类型会丢失类型，
+// AMF3的整数解析为float64，恢复后仍然是Number
+func persistable(v any, depth int) bool {
+	if depth > maxAMFDepth {
+		return false
+	}
+	switch v := v.(type) {
+	case nil, bool, float64, string:
+		return true
+	case []any:
+		for _, e := range v {
+			if !persistable(e, depth+1) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		for _, e := range v {
+			if !persistable(e, depth+1) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (so *SharedObject) load() {
+	file, err := so.file()
+	if err != nil {
+		RTMPPlugin.Warn("load shared object", zap.String("name", so.Name), zap.Error(err))
+	} else if data, err := os.ReadFile(file); err == nil {
+		if err = json.Unmarshal(data, so); err != nil {
+			RTMPPlugin.Warn("load shared object", zap.String("name", so.Name), zap.Error(err))
+		}
+	}
+	if so.Data == nil {
+		so.Data = make(map[string]any)
+	}
+}
+
+// save 持久化共享对象，没有配置目录时只保存在内存中
+func (so *SharedObject) save() error {
+	if !so.Persistent || conf.SharedObjectDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(so)
+	if err != nil {
+		return err
+	}
+	file, err := so.file()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+func (so *SharedObject) send(nc *NetConnection, events ...SharedObjectEvent) {
+	sendSharedObject(nc, SharedObjectMessage{so.Name, so.Version, so.Persistent, events, false})
+}
+
+// sendSharedObject 按照客户端的objectEncoding发送，不需要持有共享对象的锁
+func sendSharedObject(nc *NetConnection, msg SharedObjectMessage) {
+	msg.amf3 = nc.objectEncoding != 0
+	t := byte(RTMP_MSG_AMF0_SHARED)
+	if msg.amf3 {
+		t = RTMP_MSG_AMF3_SHARED
+	}
+	nc.SendMessage(t, &msg)
+}
+
+// snapshot 需要持有锁，返回当前版本的消息和客户端列表，之后在锁外发送
+func (so *SharedObject) snapshot(events ...SharedObjectEvent) (SharedObjectMessage, []*NetConnection) {
+	clients := make([]*NetConnection, 0, len(so.clients))
+	for c := range so.clients {
+		clients = append(clients, c)
+	}
+	return SharedObjectMessage{so.Name, so.Version, so.Persistent, events, false}, clients
+}
+
+func (so *SharedObject) status(nc *NetConnection, code string) {
+	so.send(nc, SharedObjectEvent{Type: RTMP_SO_STATUS, Name: code, Value: Level_Error})
+}
+
+// set 修改属性，修改者收到Success，其他客户端收到Change。持久化的共享对象拒绝无法保存的值，修改者收到Flush.Failed
+func (so *SharedObject) set(nc *NetConnection, name string, value any) {
+	if so.Persistent && !persistable(value, 0) {
+		RTMPPlugin.Warn("set shared object", zap.String("name", so.Name), zap.String("property", name), zap.Error(errSharedObjectValue))
+		so.Lock()
+		msg, _ := so.snapshot(SharedObjectEvent{Type: RTMP_SO_STATUS, Name: SharedObject_Flush_Failed, Value: Level_Error})
+		so.Unlock()
+		sendSharedObject(nc, msg)
+		return
+	}
+	so.Lock()
+	so.Data[name] = value
+	so.Version++
+	so.broadcast(nc, SharedObjectEvent{Type: RTMP_SO_CHANGE, Name: name, Value: value})
+}
+
+// remove 删除属性，删除者收到Success，其他客户端收到Remove
+func (so *SharedObject) remove(nc *NetConnection, name string) {
+	so.Lock()
+	if _, ok := so.Data[name]; !ok {
+		so.Unlock()
+		return
+	}
+	delete(so.Data, name)
+	so.Version++
+	so.broadcast(nc, SharedObjectEvent{Type: RTMP_SO_REMOVE, Name: name})
+}
+
+// broadcast 在持有锁时调用，保存之后释放锁，再发送给各个客户端，避免慢的客户端阻塞其他客户端
+func (so *SharedObject) broadcast(from *NetConnection, e SharedObjectEvent) {
+	msg, clients := so.snapshot(e)
+	err := so.save()
+	so.Unlock()
+	if err != nil {
+		RTMPPlugin.Error("save shared object", zap.String("name", so.Name), zap.Error(err))
+	}
+	success := msg
+	success.Events = []SharedObjectEvent{{Type: RTMP_SO_SUCCESS, Name: e.Name}}
+	for _, c := range clients {
+		if c == from {
+			sendSharedObject(c, success)
+		} else {
+			sendSharedObject(c, msg)
+		}
+	}
+	if err != nil {
+		msg.Events = []SharedObjectEvent{{Type: RTMP_SO_STATUS, Name: SharedObject_Flush_Failed, Value: Level_Error}}
+		sendSharedObject(from, msg)
+	}
+}
+
+// sendMessage 消息发送给所有客户端，包括发送者
+func (so *SharedObject) sendMessage(values []any) {
+	so.Lock()
+	msg, clients := so.snapshot(SharedObjectEvent{Type: RTMP_SO_SEND_MESSAGE, Values: values})
+	so.Unlock()
+	for _, c := range clients {
+		sendSharedObject(c, msg)
+	}
+}
+
+// useSharedObject 连接共享对象，不存在时创建，持久化的共享对象从文件中恢复。连接成功后发送全部属性
+func (nc *NetConnection) useSharedObject(name string, persistent bool) *SharedObject {
+	if so := nc.sharedObjects[name]; so != nil {
+		return so
+	}
+	if nc.appPath == "" {
+		(&SharedObject{Name: name, Persistent: persistent}).status(nc, SharedObject_UriMismatch)
+		return nil
+	}
+	// 不同vhost中的同名应用使用不同的共享对象
+	key := nc.appPath + "/" + name
+	// 持有全局锁直到加入客户端，避免最后一个客户端同时断开导致共享对象被删除
+	sharedObjectsLock.Lock()
+	so := sharedObjects[key]
+	if so == nil {
+		so = &SharedObject{App: nc.appPath, Name: name, Persistent: persistent, Data: make(map[string]any), clients: make(map[*NetConnection]struct{})}
+		if persistent && conf.SharedObjectDir != "" {
+			so.load()
+		}
+		sharedObjects[key] = so
+	}
+	so.Lock()
+	if so.Persistent != persistent {
+		msg, _ := so.snapshot(SharedObjectEvent{Type: RTMP_SO_STATUS, Name: SharedObject_BadPersistence, Value: Level_Error})
+		so.Unlock()
+		sharedObjectsLock.Unlock()
+		sendSharedObject(nc, msg)
+		return nil
+	}
+	so.clients[nc] = struct{}{}
+	// 在锁中生成全部属性的快照，释放锁之后再发送，避免慢的客户端阻塞其他连接
+	events := []SharedObjectEvent{{Type: RTMP_SO_USE_SUCCESS}, {Type: RTMP_SO_CLEAR}}
+	for k, v := range so.Data {
+		events = append(events, SharedObjectEvent{Type: RTMP_SO_CHANGE, Name: k, Value: v})
+	}
+	msg, _ := so.snapshot(events...)
+	so.Unlock()
+	sharedObjectsLock.Unlock()
+	if nc.sharedObjects == nil {
+		nc.sharedObjects = make(map[string]*SharedObject)
+	}
+	nc.sharedObjects[name] = so
+	sendSharedObject(nc, msg)
+	return so
+}
+
+// releaseSharedObject 断开共享对象，没有客户端的临时共享对象会被删除
+func (nc *NetConnection) releaseSharedObject(name string) {
+	so := nc.sharedObjects[name]
+	if so == nil {
+		return
+	}
+	delete(nc.sharedObjects, name)
+	sharedObjectsLock.Lock()
+	defer sharedObjectsLock.Unlock()
+	so.Lock()
+	defer so.Unlock()
+	delete(so.clients, nc)
+	if len(so.clients) == 0 && !so.Persistent {
+		delete(sharedObjects, so.App+"/"+so.Name)
+	}
+}
+
+// releaseSharedObjects 连接关闭时断开所有共享对象
+func (nc *NetConnection) releaseSharedObjects() {
+	for name := range nc.sharedObjects {
+		nc.releaseSharedObject(name)
+	}
+}
+
+// ReceiveSharedObject 处理客户端发送的共享对象消息，修改、删除和广播消息需要先连接共享对象
+func (nc *NetConnection) ReceiveSharedObject(msg *SharedObjectMessage) {
+	for _, e := range msg.Events {
+		if e.Type == RTMP_SO_USE {
+			nc.useSharedObject(msg.Name, msg.Persistent)
+			continue
+		}
+		so := nc.sharedObjects[msg.Name]
+		if so == nil {
+			continue
+		}
+		switch e.Type {
+		case RTMP_SO_RELEASE:
+			nc.releaseSharedObject(msg.Name)
+		case RTMP_SO_REQUEST_CHANGE:
+			so.set(nc, e.Name, e.Value)
+		case RTMP_SO_REQUEST_REMOVE:
+			so.remove(nc, e.Name)
+		case RTMP_SO_SEND_MESSAGE:
+			so.sendMessage(e.Values)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newSOConn 创建已经connect到appPath的连接，发送的消息写入bufferConn
+func newSOConn(appPath string, objectEncoding float64) (*NetConnection, *bufferConn) {
+	c := &bufferConn{reader: bytes.NewReader(nil)}
+	nc := NewNetConnection(c)
+	nc.appPath = appPath
+	nc.objectEncoding = objectEncoding
+	return nc, c
+}
+
+// sentSharedObjects 解析并清空连接上发送的共享对象消息，每个消息都在一个chunk中
+func sentSharedObjects(t *testing.T, c *bufferConn) (msgs []*SharedObjectMessage) {
+	t.Helper()
+	b := c.written.Bytes()
+	for len(b) > 0 {
+		if len(b) < 12 || b[0] != RTMP_CSID_COMMAND {
+			t.Fatalf("unexpected chunk %x", b)
+		}
+		length := int(b[4])<<16 | int(b[5])<<8 | int(b[6])
+		chunk := &Chunk{ChunkHeader: ChunkHeader{MessageTypeID: b[7], MessageStreamID: binary.LittleEndian.Uint32(b[8:])}}
+		if err := GetRtmpMessage(chunk, b[12:12+length]); err != nil {
+			t.Fatal(err)
+		}
+		msg, ok := chunk.MsgData.(*SharedObjectMessage)
+		if !ok {
+			t.Fatalf("message type %d", chunk.MessageTypeID)
+		}
+		msgs = append(msgs, msg)
+		b = b[12+length:]
+	}
+	c.written.Reset()
+	return
+}
+
+// eventTypes 返回消息中的事件类型和名称，例如4:k表示属性k的Change
+func eventTypes(msgs []*SharedObjectMessage) (events []string) {
+	for _, msg := range msgs {
+		for _, e := range msg.Events {
+			events = append(events, strconv.Itoa(int(e.Type))+":"+e.Name)
+		}
+	}
+	return
+}
+
+func soMessage(name string, persistent bool, events ...SharedObjectEvent) *SharedObjectMessage {
+	return &SharedObjectMessage{Name: name, Persistent: persistent, Events: events}
+}
+
+// useSO 在测试结束时断开并删除共享对象
+func useSO(t *testing.T, nc *NetConnection, name string, persistent bool) {
+	nc.ReceiveSharedObject(soMessage(name, persistent, SharedObjectEvent{Type: RTMP_SO_USE}))
+	t.Cleanup(func() {
+		nc.releaseSharedObjects()
+		sharedObjectsLock.Lock()
+		delete(sharedObjects, nc.appPath+"/"+name)
+		sharedObjectsLock.Unlock()
+	})
+}
+
+func TestSharedObject(t *testing.T) {
+	a, ca := newSOConn("v1/live", 0)
+	b, cb := newSOConn("v1/live", 3)
+	useSO(t, a, "chat", false)
+	if got := strings.Join(eventTypes(sentSharedObjects(t, ca)), " "); got != "11: 8:" {
+		t.Errorf("use: %s", got)
+	}
+	a.ReceiveSharedObject(soMessage("chat", false, SharedObjectEvent{Type: RTMP_SO_REQUEST_CHANGE, Name: "k", Value: "v"}))
+	if got := strings.Join(eventTypes(sentSharedObjects(t, ca)), " "); got != "5:k" {
+		t.Errorf("set: %s", got)
+	}
+	// 后连接的客户端收到全部属性
+	useSO(t, b, "chat", false)
+	msgs := sentSharedObjects(t, cb)
+	if got := strings.Join(eventTypes(msgs), " "); got != "11: 8: 4:k" || msgs[0].Version != 1 {
+		t.Errorf("use: %s, version %d", got, msgs[0].Version)
+	}
+	b.ReceiveSharedObject(soMessage("chat", false, SharedObjectEvent{Type: RTMP_SO_REQUEST_CHANGE, Name: "k2", Value: map[string]any{"x": 1.0}}))
+	if got := strings.Join(eventTypes(sentSharedObjects(t, cb)), " "); got != "5:k2" {
+		t.Errorf("set by b: %s", got)
+	}
+	if msgs = sentSharedObjects(t, ca); strings.Join(eventTypes(msgs), " ") != "4:k2" || msgs[0].Version != 2 {
+		t.Errorf("change sent to a: %v", eventTypes(msgs))
+	}
+	a.ReceiveSharedObject(soMessage("chat", false, SharedObjectEvent{Type: RTMP_SO_REQUEST_REMOVE, Name: "k"}))
+	if got := strings.Join(eventTypes(sentSharedObjects(t, ca)), " "); got != "5:k" {
+		t.Errorf("remove: %s", got)
+	}
+	if got := strings.Join(eventTypes(sentSharedObjects(t, cb)), " "); got != "9:k" {
+		t.Errorf("remove sent to b: %s", got)
+	}
+	// 删除不存在的属性没有通知
+	a.ReceiveSharedObject(soMessage("chat", false, SharedObjectEvent{Type: RTMP_SO_REQUEST_REMOVE, Name: "k"}))
+	a.ReceiveSharedObject(soMessage("chat", false, SharedObjectEvent{Type: RTMP_SO_SEND_MESSAGE, Values: []any{"onMsg", "hi"}}))
+	for _, c := range []*bufferConn{ca, cb} {
+		if got := strings.Join(eventTypes(sentSharedObjects(t, c)), " "); got != "6:" {
+			t.Errorf("send message: %s", got)
+		}
+	}
+	so := a.sharedObjects["chat"]
+	if so.Version != 3 || len(so.Data) != 1 || so.Data["k2"] == nil {
+		t.Errorf("version %d, data %v", so.Version, so.Data)
+	}
+	// 以不同的persistent标志连接
+	c, cc := newSOConn("v1/live", 0)
+	c.ReceiveSharedObject(soMessage("chat", true, SharedObjectEvent{Type: RTMP_SO_USE}))
+	if got := strings.Join(eventTypes(sentSharedObjects(t, cc)), " "); got != "7:"+SharedObject_BadPersistence || c.sharedObjects["chat"] != nil {
+		t.Errorf("bad persistence: %s", got)
+	}
+	// 没有连接共享对象时忽略修改
+	c.ReceiveSharedObject(soMessage("chat", false, SharedObjectEvent{Type: RTMP_SO_REQUEST_CHANGE, Name: "x", Value: "y"}))
+	if so.Data["x"] != nil || cc.written.Len() != 0 {
+		t.Error("change without use")
+	}
+	// 最后一个客户端断开时删除临时共享对象
+	a.ReceiveSharedObject(soMessage("chat", false, SharedObjectEvent{Type: RTMP_SO_RELEASE}))
+	b.releaseSharedObjects()
+	sharedObjectsLock.Lock()
+	_, ok := sharedObjects["v1/live/chat"]
+	sharedObjectsLock.Unlock()
+	if ok || a.sharedObjects["chat"] != nil {
+		t.Error("shared object not removed")
+	}
+}
+
+// 不同vhost中的同名应用使用不同的共享对象，没有connect时响应UriMismatch
+func TestSharedObjectVhost(t *testing.T) {
+	a, _ := newSOConn("v1/live", 0)
+	b, _ := newSOConn("v2/live", 0)
+	c, _ := newSOConn("v1/live", 0)
+	for _, nc := range []*NetConnection{a, b, c} {
+		useSO(t, nc, "chat", false)
+	}
+	if a.sharedObjects["chat"] == b.sharedObjects["chat"] || a.sharedObjects["chat"] != c.sharedObjects["chat"] {
+		t.Error("shared objects not keyed by vhost app path")
+	}
+	d, cd := newSOConn("", 0)
+	d.ReceiveSharedObject(soMessage("chat", false, SharedObjectEvent{Type: RTMP_SO_USE}))
+	if got := strings.Join(eventTypes(sentSharedObjects(t, cd)), " "); got != "7:"+SharedObject_UriMismatch {
+		t.Errorf("use before connect: %s", got)
+	}
+}
+
+func setSharedObjectDir(t *testing.T) string {
+	dir := t.TempDir()
+	old := conf.SharedObjectDir
+	conf.SharedObjectDir = dir
+	t.Cleanup(func() { conf.SharedObjectDir = old })
+	return dir
+}
+
+// 持久化的共享对象在没有客户端时保留，从文件恢复属性和版本，无法保存为JSON的值被拒绝
+func TestSharedObjectPersistence(t *testing.T) {
+	dir := setSharedObjectDir(t)
+	a, ca := newSOConn("v1/live", 3)
+	useSO(t, a, "score", true)
+	a.ReceiveSharedObject(soMessage("score", true, SharedObjectEvent{Type: RTMP_SO_REQUEST_CHANGE, Name: "n", Value: map[string]any{"a": 1.0, "b": []any{"x", true, nil}}}))
+	sentSharedObjects(t, ca)
+	for _, v := range []any{[]byte{1}, []int32{1}, map[string]any{"v": []float64{1}}} {
+		a.ReceiveSharedObject(soMessage("score", true, SharedObjectEvent{Type: RTMP_SO_REQUEST_CHANGE, Name: "bad", Value: v}))
+		if got := strings.Join(eventTypes(sentSharedObjects(t, ca)), " "); got != "7:"+SharedObject_Flush_Failed {
+			t.Errorf("%T: %s", v, got)
+		}
+	}
+	a.releaseSharedObjects()
+	sharedObjectsLock.Lock()
+	so := sharedObjects["v1/live/score"]
+	// 删除内存中的共享对象，下次连接时从文件恢复
+	delete(sharedObjects, "v1/live/score")
+	sharedObjectsLock.Unlock()
+	if so == nil || so.Data["bad"] != nil || so.Version != 1 {
+		t.Fatalf("persistent shared object %+v", so)
+	}
+	file, err := so.file()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "v1%2Flive", "score.json")); err != nil || file != filepath.Join(dir, "v1%2Flive", "score.json") {
+		t.Fatalf("file %s: %v", file, err)
+	}
+
+	b, _ := newSOConn("v1/live", 0)
+	useSO(t, b, "score", true)
+	loaded := b.sharedObjects["score"]
+	if loaded == so || loaded.Version != 1 || loaded.Data["n"].(map[string]any)["a"] != 1.0 || len(loaded.Data["n"].(map[string]any)["b"].([]any)) != 3 {
+		t.Errorf("loaded %+v", loaded)
+	}
+	// 临时共享对象不保存
+	useSO(t, b, "temp", false)
+	b.ReceiveSharedObject(soMessage("temp", false, SharedObjectEvent{Type: RTMP_SO_REQUEST_CHANGE, Name: "bytes", Value: []byte{1}}))
+	if _, err = os.Stat(filepath.Join(dir, "v1%2Flive", "temp.json")); !os.IsNotExist(err) {
+		t.Errorf("temporary shared object saved: %v", err)
+	}
+}
+
+// 应用和名称中的.和路径分隔符被转义，文件总是在SharedObjectDir中
+func TestSharedObjectFile(t *testing.T) {
+	dir := setSharedObjectDir(t)
+	tests := []struct{ app, name, want string }{
+		{"live", "chat", "live/chat.json"},
+		{"v1/live", "room/1", "v1%2Flive/room%2F1.json"},
+		{"..", "..", "%2E./%2E..json"},
+		{"live", "../../etc/passwd", "live/%2E.%2F..%2Fetc%2Fpasswd.json"},
+		{"live", `..\x`, "live/%2E.%5Cx.json"},
+		{".", ".hidden", "%2E/%2Ehidden.json"},
+	}
+	for _, tt := range tests {
+		file, err := (&SharedObject{App: tt.app, Name: tt.name}).file()
+		if err != nil || file != filepath.Join(dir, filepath.FromSlash(tt.want)) {
+			t.Errorf("%s %s: %s, %v", tt.app, tt.name, file, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package rtmp
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/common"
+)
+
+// completeSwitch 在发送帧的协程中调用，等到关键帧后停止旧的订阅者，并使时间戳与旧的订阅者连续
+func (rtmp *RTMPSender) completeSwitch(frame *common.AVFrame, isVideo bool) bool {
+	if rtmp.videoSeq != nil && !(isVideo && frame.IFrame) {
+		return false
+	}
+	old := rtmp.switching
+	rtmp.switching = nil
+	old.paused.Store(true)
+	old.switched.Store(true)
+	old.Stop(zap.String("reason", "switch to "+rtmp.Stream.Path))
+	// 旧的订阅者的协程可能还没有退出，detach之后它不会再修改时间轴
+	started, lastTS, timeOffset, played := old.clock.detach()
+	ts := uint32(frame.Timestamp / time.Millisecond)
+	rtmp.clock.Lock()
+	// play的duration按切换前后的总时长计算
+	rtmp.clock.played = played
+	if started {
+		rtmp.clock.timeOffset = ts - (lastTS - timeOffset)
+		rtmp.clock.lastTS = ts
+		rtmp.clock.started = true
+	}
+	rtmp.clock.Unlock()
+	rtmp.switchPending.Store(false)
+	rtmp.sendSequenceHeads(rtmp.audioSeq, rtmp.videoSeq)
+	rtmp.Response(0, NetStream_Play_Switch, Level_Status)
+	return true
+}
+
+// newSwitchSender 创建play2切换到info的订阅者，继承old的NetStream、播放参数和附加轨道的选择
+func newSwitchSender(old *RTMPSubscriber, info *StreamInfo) *RTMPSubscriber {
+	sender := &RTMPSubscriber{}
+	sender.NetStream = old.NetStream
+	sender.streamInfo = info
+	sender.switching = &old.RTMPSender
+	sender.switchPending.Store(true)
+	sender.duration = old.duration
+	sender.audio.muted.Store(old.audio.muted.Load())
+	sender.video.muted.Store(old.video.muted.Load())
+	sender.captionMode = old.captionMode
+	sender.ID = old.ID
+	sender.aggregate.size = old.aggregate.size
+	sender.aggregate.maxDuration = old.aggregate.maxDuration
+	// 新的流名称没有指定时沿用之前订阅的附加轨道
+	for _, key := range []string{"audioTracks", "videoTracks"} {
+		if info.Args.Get(key) == "" && old.streamInfo.Args.Get(key) != "" {
+			info.Args.Set(key, old.streamInfo.Args.Get(key))
+		}
+	}
+	return sender
+}
@@ -0,0 +1,81 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+
+	engine "m7s.live/engine/v4"
+	"m7s.live/engine/v4/common"
+)
+
+// play2创建的订阅者继承播放参数，没有指定附加轨道时沿用之前的选择
+func TestNewSwitchSender(t *testing.T) {
+	old := &RTMPSubscriber{}
+	old.NetStream = NetStream{nil, 1, newStreamInfo(nil, "live", "a?audioTracks=1,2")}
+	old.duration = 30000
+	old.video.muted.Store(true)
+	old.captionMode = "sei"
+	old.ID = "sub1"
+
+	sender := newSwitchSender(old, newStreamInfo(nil, "live", "b"))
+	if sender.duration != 30000 || !sender.video.muted.Load() || sender.audio.muted.Load() || sender.captionMode != "sei" || sender.ID != "sub1" {
+		t.Errorf("state not copied: duration %d, captionMode %q, ID %q", sender.duration, sender.captionMode, sender.ID)
+	}
+	if sender.StreamID != 1 || sender.streamInfo.StreamPath != "live/b" || sender.switching != &old.RTMPSender || !sender.switchPending.Load() {
+		t.Errorf("streamID %d, streamPath %q", sender.StreamID, sender.streamInfo.StreamPath)
+	}
+	if got := sender.streamInfo.Get("audioTracks"); got != "1,2" {
+		t.Errorf("audioTracks %q", got)
+	}
+	if sender = newSwitchSender(old, newStreamInfo(nil, "live", "b?audioTracks=3")); sender.streamInfo.Get("audioTracks") != "3" {
+		t.Errorf("audioTracks %q", sender.streamInfo.Get("audioTracks"))
+	}
+}
+
+// 切换在新流的关键帧处完成，时间戳与旧的订阅者连续，已播放的时长累计
+func TestCompleteSwitch(t *testing.T) {
+	// 没有连接时发送的消息直接返回错误
+	old := &RTMPSubscriber{}
+	old.NetStream = NetStream{nil, 1, newStreamInfo(nil, "live", "a")}
+	old.Stream = &engine.Stream{Path: "live/a"}
+	old.clock.started = true
+	old.clock.lastTS = 5000
+	old.clock.timeOffset = 1000
+	old.clock.played = 4000
+
+	sender := newSwitchSender(old, newStreamInfo(nil, "live", "b"))
+	sender.Stream = &engine.Stream{Path: "live/b"}
+	sender.metaSent.Store(true)
+	sender.videoSeq = []byte{0x17, 0}
+	if sender.completeSwitch(&common.AVFrame{Timestamp: 90 * time.Second}, true) {
+		t.Fatal("switched on a P-frame")
+	}
+	if sender.completeSwitch(&common.AVFrame{Timestamp: 90 * time.Second}, false) {
+		t.Fatal("switched on audio before the first keyframe")
+	}
+	if !sender.switchPending.Load() || old.switched.Load() {
+		t.Fatal("switch completed early")
+	}
+	// 没有视频的流在第一个音频帧处切换
+	sender.videoSeq = nil
+	if !sender.completeSwitch(&common.AVFrame{Timestamp: 100 * time.Second}, false) {
+		t.Fatal("audio-only stream did not complete the switch")
+	}
+	if sender.switching != nil || sender.switchPending.Load() || !old.switched.Load() || !old.paused.Load() {
+		t.Error("switch state not updated")
+	}
+	// 旧的订阅者最后发送的客户端时间戳为4000，新流的100000对应客户端的4000
+	if started, lastTS := sender.clock.position(); !started || lastTS != 100000 || sender.clock.offset() != 96000 {
+		t.Errorf("started %v, lastTS %d, offset %d", started, lastTS, sender.clock.offset())
+	}
+	if played := sender.clock.playedTime(); played != 4000 {
+		t.Errorf("played %d", played)
+	}
+	// 旧的订阅者的协程之后不再修改时间轴
+	old.clock.Lock()
+	old.clock.advance(6000)
+	old.clock.Unlock()
+	if old.clock.lastTS != 5000 {
+		t.Errorf("old clock advanced to %d", old.clock.lastTS)
+	}
+}
@@ -0,0 +1,34 @@
+package rtmp
+
+import "path"
+
+// VhostConfig 虚拟主机配置，vhost取自tcUrl的host或者vhost参数
+type VhostConfig struct {
+	Prefix  string               `desc:"streamPath前缀，默认为vhost名称"`
+	Default AppConfig            `desc:"该vhost下应用的默认配置"`
+	Apps    map[string]AppConfig `desc:"该vhost的应用配置，为空则使用全局apps"`
+}
+
+// matchPattern 先精确匹配再按通配符匹配（取最长的模式，长度相同时取字典序较小的，结果不依赖map的遍历顺序）
+func matchPattern[T any](m map[string]T, name string) (value T, ok bool) {
+	if value, ok = m[name]; ok {
+		return
+	}
+	var matched string
+	for pattern, v := range m {
+		if ok, _ := path.Match(pattern, name); ok && (len(pattern) > len(matched) || len(pattern) == len(matched) && pattern < matched) {
+			matched, value = pattern, v
+		}
+	}
+	return value, matched != ""
+}
+
+// resolveStream 解析流名称。connect时的应用白名单和回调是按connect的vhost执行的，
+// 所以流名称中的vhost参数只能与其相同，不同时返回的app为nil表示拒绝
+func (c *RTMPConfig) resolveStream(nc *NetConnection, app *AppConfig, name string) (*StreamInfo, *AppConfig) {
+	info := newStreamInfo(nc.connectInfo, app.appPath(nc.appName), name)
+	if vhost := info.Args.Get("vhost"); vhost != "" && vhost != info.Vhost {
+		return info, nil
+	}
+	return info, app
+}
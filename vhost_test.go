@@ -0,0 +1,78 @@
+package rtmp
+
+import "testing"
+
+// 长度相同的通配符按字典序选择，与map的遍历顺序无关
+func TestMatchPatternTie(t *testing.T) {
+	m := map[string]int{"*ive": 1, "liv*": 2, "l*": 3}
+	for i := 0; i < 20; i++ {
+		if v, ok := matchPattern(m, "live"); !ok || v != 1 {
+			t.Fatalf("got %d", v)
+		}
+	}
+	if v, ok := matchPattern(m, "lx"); !ok || v != 3 {
+		t.Fatalf("got %d", v)
+	}
+	if _, ok := matchPattern(m, "other"); ok {
+		t.Fatal("unexpected match")
+	}
+}
+
+func TestFindAppVhost(t *testing.T) {
+	c := &RTMPConfig{
+		ChunkSize: 65535,
+		Apps:      map[string]AppConfig{"live": {}},
+		Vhosts: map[string]VhostConfig{
+			"a.example.com": {Default: AppConfig{ChunkSize: 4096}},
+			"*.example.net": {Prefix: "customer2", Apps: map[string]AppConfig{"tv": {Allow: AllowPlay}}},
+		},
+	}
+	tests := []struct {
+		vhost, app string
+		found      bool
+		path       string
+		chunkSize  int
+	}{
+		{"a.example.com", "live", true, "a.example.com/live", 4096}, // vhost没有apps时使用全局apps
+		{"a.example.com", "other", false, "", 0},
+		{"b.example.net", "tv", true, "customer2/tv", 65535},
+		{"b.example.net", "live", false, "", 0},   // vhost的apps替换全局apps
+		{"10.0.0.1", "live", true, "live", 65535}, // 没有配置的vhost使用全局配置，不加前缀
+		{"c.example.org", "live", true, "live", 65535},
+	}
+	for _, tt := range tests {
+		app := c.findApp(tt.vhost, tt.app)
+		if (app != nil) != tt.found {
+			t.Fatalf("%s %s: found %v", tt.vhost, tt.app, app != nil)
+		}
+		if app != nil && (app.appPath(tt.app) != tt.path || app.ChunkSize != tt.chunkSize) {
+			t.Errorf("%s %s: path %q, chunkSize %d", tt.vhost, tt.app, app.appPath(tt.app), app.ChunkSize)
+		}
+	}
+}
+
+func TestResolveStreamVhost(t *testing.T) {
+	c := &RTMPConfig{Vhosts: map[string]VhostConfig{"a.example.com": {}}}
+	tests := []struct {
+		tcUrl, name string
+		ok          bool
+		path        string
+	}{
+		{"rtmp://a.example.com/live", "test", true, "a.example.com/live/test"},
+		{"rtmp://a.example.com/live", "test?vhost=a.example.com", true, "a.example.com/live/test"},
+		{"rtmp://a.example.com/live", "test?vhost=b.example.com", false, ""},
+		{"rtmp://10.0.0.1/live?vhost=a.example.com", "test", true, "a.example.com/live/test"},
+		{"rtmp://10.0.0.1/live", "test?vhost=a.example.com", false, ""}, // connect时的vhost是10.0.0.1
+	}
+	for _, tt := range tests {
+		nc := &NetConnection{appName: "live", connectInfo: newConnectInfo(map[string]any{"app": "live", "tcUrl": tt.tcUrl}, "10.0.0.2:5000")}
+		app := c.findApp(nc.connectInfo.Vhost, nc.appName)
+		info, resolved := c.resolveStream(nc, app, tt.name)
+		if (resolved != nil) != tt.ok {
+			t.Fatalf("%s %s: resolved %v", tt.tcUrl, tt.name, resolved != nil)
+		}
+		if resolved != nil && info.StreamPath != tt.path {
+			t.Errorf("%s %s: streamPath %q", tt.tcUrl, tt.name, info.StreamPath)
+		}
+	}
+}